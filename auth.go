@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookie     = "lan-share-session"
+	adminCookie       = "lan-share-admin"
+	passwordHashAlgo  = "pbkdf2-sha256"
+	passwordHashIter  = 200000
+	passwordSaltSize  = 16
+	sessionKeySize    = 32
+	sessionIDSize     = 16
+	loginFailureDelay = time.Second
+)
+
+var (
+	// passwordCheck is nil if authentication is disabled
+	passwordCheck func(password string) bool
+	// adminCheck is nil if there is no admin
+	adminCheck func(password string) bool
+	sessionKey []byte
+
+	loginPage = template.Must(template.New("login").Parse(LoginPageTemplate))
+
+	errBadPasswordHash = errors.New("malformed password hash, generate it with -hash-password")
+)
+
+// initAuth enables authentication with the password from the flags, and the
+// admin password if any.
+func initAuth() error {
+	if *adminHashFile != "" {
+		var err error
+		if adminCheck, err = readPasswordHash(*adminHashFile); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case *passwordFile != "":
+		var err error
+		if passwordCheck, err = readPasswordHash(*passwordFile); err != nil {
+			return err
+		}
+	case *password != "":
+		expected := []byte(*password)
+		passwordCheck = func(password string) bool {
+			return subtle.ConstantTimeCompare([]byte(password), expected) == 1
+		}
+	}
+	if passwordCheck == nil && adminCheck == nil {
+		return nil
+	}
+
+	key, err := loadSessionKey()
+	if err != nil {
+		return err
+	}
+	sessionKey = key
+	return nil
+}
+
+func authEnabled() bool {
+	return passwordCheck != nil
+}
+
+// isAdmin reports whether r comes from an admin logged in at /admin.
+func isAdmin(r *http.Request) bool {
+	return adminCheck != nil && hasSession(r, adminCookie)
+}
+
+// loadSessionKey returns the key signing session cookies, it is kept in the
+// data directory if any so sessions survive a restart.
+func loadSessionKey() ([]byte, error) {
+	if *dataDir == "" {
+		return randomBytes(sessionKeySize)
+	}
+	path := filepath.Join(*dataDir, "session.key")
+	if key, err := os.ReadFile(path); err == nil && len(key) == sessionKeySize {
+		return key, nil
+	}
+	key, err := randomBytes(sessionKeySize)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(*dataDir, 0o700); err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, key, 0o600)
+}
+
+// hashPassword reads a password from r and writes its hash to w, in the
+// format accepted by -password-file.
+func hashPassword(r io.Reader, w io.Writer) error {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return errors.New("empty password")
+	}
+	salt, err := randomBytes(passwordSaltSize)
+	if err != nil {
+		return err
+	}
+	key := pbkdf2SHA256([]byte(line), salt, passwordHashIter, sha256.Size)
+	_, err = fmt.Fprintf(w, "%s$%d$%s$%s\n",
+		passwordHashAlgo,
+		passwordHashIter,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+	return err
+}
+
+// readPasswordHash parses the hash on the first line of a password file.
+func readPasswordHash(path string) (func(password string) bool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePasswordHash(strings.TrimSpace(strings.SplitN(string(content), "\n", 2)[0]))
+}
+
+func parsePasswordHash(hash string) (func(password string) bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordHashAlgo {
+		return nil, errBadPasswordHash
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return nil, errBadPasswordHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errBadPasswordHash
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(expected) == 0 {
+		return nil, errBadPasswordHash
+	}
+	return func(password string) bool {
+		return hmac.Equal(pbkdf2SHA256([]byte(password), salt, iter, len(expected)), expected)
+	}, nil
+}
+
+// pbkdf2SHA256 derives a key from password, see RFC 8018.
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := make([]byte, 0, keyLen+sha256.Size)
+	u := make([]byte, sha256.Size)
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u = prf.Sum(u[:0])
+		t := append([]byte(nil), u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// newSession returns a value of the cookie name, [8 byte expiry][random id]
+// signed with sessionKey along with the name, so the value of a cookie is no
+// good for another.
+func newSession(name string, expire time.Time) (string, error) {
+	payload, err := randomBytes(8 + sessionIDSize)
+	if err != nil {
+		return "", err
+	}
+	binary.BigEndian.PutUint64(payload, uint64(expire.Unix()))
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signSession(name, payload)), nil
+}
+
+func validSession(name, value string) bool {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(payload) != 8+sessionIDSize {
+		return false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, signSession(name, payload)) {
+		return false
+	}
+	return time.Now().Unix() < int64(binary.BigEndian.Uint64(payload))
+}
+
+func signSession(name string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func hasSession(r *http.Request, name string) bool {
+	cookie, err := r.Cookie(name)
+	return err == nil && validSession(name, cookie.Value)
+}
+
+func authenticated(r *http.Request) bool {
+	return hasSession(r, sessionCookie)
+}
+
+// withAuth puts the login page in front of every route of next.
+func withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled() || r.URL.Path == "/login" || authenticated(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == http.MethodGet && (r.URL.Path == "/" || r.URL.Path == "/admin" || strings.HasPrefix(r.URL.Path, "/index.")) {
+			http.Redirect(w, r, "/login?"+url.Values{"next": {r.URL.RequestURI()}}.Encode(), http.StatusSeeOther)
+			return
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func login(w http.ResponseWriter, r *http.Request) {
+	if !authEnabled() {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	passwordLogin(w, r, sessionCookie, passwordCheck)
+}
+
+// adminLogin gives the admin rights to the websockets opened afterwards.
+func adminLogin(w http.ResponseWriter, r *http.Request) {
+	if adminCheck == nil {
+		http.NotFound(w, r)
+		return
+	}
+	passwordLogin(w, r, adminCookie, adminCheck)
+}
+
+// passwordLogin serves the login form of r.URL.Path, and sets the session
+// cookie name once check accepts the password posted.
+func passwordLogin(w http.ResponseWriter, r *http.Request, name string, check func(password string) bool) {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+	data := struct {
+		Action string
+		Admin  bool
+		Next   string
+		Error  string
+	}{Action: r.URL.Path, Admin: name == adminCookie, Next: next}
+
+	if r.Method == http.MethodPost {
+		if check(r.PostFormValue("password")) {
+			expire := time.Now().Add(*sessionExpire)
+			value, err := newSession(name, expire)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     name,
+				Value:    value,
+				Path:     "/",
+				Expires:  expire,
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		log.Printf("Failed login at %s from %s", r.URL.Path, r.RemoteAddr)
+		time.Sleep(loginFailureDelay)
+		data.Error = "Wrong password"
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; form-action 'self'; style-src 'unsafe-inline'")
+	loginPage.Execute(w, data)
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
+	for _, name := range []string{sessionCookie, adminCookie} {
+		http.SetCookie(w, &http.Cookie{
+			Name:   name,
+			Path:   "/",
+			MaxAge: -1,
+		})
+	}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
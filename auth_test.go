@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setAuth sets the session key and password checks until the test ends.
+func setAuth(t *testing.T, check, admin func(password string) bool) {
+	key, password, adminPassword := sessionKey, passwordCheck, adminCheck
+	t.Cleanup(func() { sessionKey, passwordCheck, adminCheck = key, password, adminPassword })
+	sessionKey = bytes.Repeat([]byte{7}, sessionKeySize)
+	passwordCheck, adminCheck = check, admin
+}
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// RFC 7914, section 11
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if got := hex.EncodeToString(pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64)); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	var hashes [2]string
+	for i := range hashes {
+		var out strings.Builder
+		if err := hashPassword(strings.NewReader("secret\r\nignored"), &out); err != nil {
+			t.Fatal(err)
+		}
+		hashes[i] = strings.TrimSpace(out.String())
+	}
+	if hashes[0] == hashes[1] {
+		t.Error("the same password hashed twice alike, the salt is not random")
+	}
+	check, err := parsePasswordHash(hashes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for password, want := range map[string]bool{"secret": true, "Secret": false, "secret\r": false, "": false} {
+		if got := check(password); got != want {
+			t.Errorf("%q accepted: %v, want %v", password, got, want)
+		}
+	}
+
+	if err := hashPassword(strings.NewReader("\n"), &strings.Builder{}); err == nil {
+		t.Error("empty password hashed")
+	}
+}
+
+func TestParsePasswordHash(t *testing.T) {
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"empty", ""},
+		{"other algorithm", "bcrypt$1$c2FsdA$a2V5"},
+		{"missing part", "pbkdf2-sha256$1$c2FsdA"},
+		{"extra part", "pbkdf2-sha256$1$c2FsdA$a2V5$"},
+		{"bad iterations", "pbkdf2-sha256$x$c2FsdA$a2V5"},
+		{"no iterations", "pbkdf2-sha256$0$c2FsdA$a2V5"},
+		{"bad salt", "pbkdf2-sha256$1$c2Fsd!$a2V5"},
+		{"bad key", "pbkdf2-sha256$1$c2FsdA$a2V!"},
+		{"empty key", "pbkdf2-sha256$1$c2FsdA$"},
+	}
+	for _, tt := range tests {
+		if _, err := parsePasswordHash(tt.hash); err != errBadPasswordHash {
+			t.Errorf("%s: got %v, want %v", tt.name, err, errBadPasswordHash)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	setAuth(t, nil, nil)
+	valid, err := newSession(sessionCookie, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := newSession(sessionCookie, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, mac, _ := strings.Cut(valid, ".")
+	flip := func(s string) string {
+		b := []byte(s)
+		if b[0] == 'A' {
+			b[0] = 'B'
+		} else {
+			b[0] = 'A'
+		}
+		return string(b)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		want  bool
+	}{
+		{"valid", valid, true},
+		{"expired", expired, false},
+		{"tampered payload", flip(payload) + "." + mac, false},
+		{"tampered mac", payload + "." + flip(mac), false},
+		{"expiry of another", strings.SplitN(expired, ".", 2)[0] + "." + mac, false},
+		{"no mac", payload, false},
+		{"empty mac", payload + ".", false},
+		{"bad encoding", payload + ".!" + mac, false},
+		{"short payload", payload[4:] + "." + mac, false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		if got := validSession(sessionCookie, tt.value); got != tt.want {
+			t.Errorf("%s: valid %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// a cookie is no good for another
+	if validSession(adminCookie, valid) {
+		t.Error("session cookie valid as the admin cookie")
+	}
+	// nor once the key changes
+	sessionKey = bytes.Repeat([]byte{8}, sessionKeySize)
+	if validSession(sessionCookie, valid) {
+		t.Error("session cookie valid with another key")
+	}
+}
+
+func TestWithAuth(t *testing.T) {
+	setAuth(t, func(password string) bool { return password == "secret" }, func(string) bool { return false })
+	handler := withAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			login(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve(httptest.NewRequest(http.MethodGet, "/?room=a", nil)); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login?next=%2F%3Froom%3Da" {
+		t.Errorf("page: got %d to %q, want a redirect to the login", w.Code, w.Header().Get("Location"))
+	}
+	if w := serve(httptest.NewRequest(http.MethodGet, "/ws", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("websocket: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := serve(httptest.NewRequest(http.MethodGet, "/login", nil)); w.Code != http.StatusOK {
+		t.Errorf("login page: got %d, want %d", w.Code, http.StatusOK)
+	}
+
+	form := url.Values{"password": {"secret"}, "next": {"//evil.example/"}}
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := serve(r)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Fatalf("login: got %d to %q, want a redirect to /", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie || !cookies[0].HttpOnly {
+		t.Fatalf("login set cookies %v", cookies)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.AddCookie(cookies[0])
+	if w := serve(r); w.Code != http.StatusOK {
+		t.Errorf("websocket with the session: got %d, want %d", w.Code, http.StatusOK)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: cookies[0].Value + "x"})
+	if w := serve(r); w.Code != http.StatusUnauthorized {
+		t.Errorf("websocket with a tampered session: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.AddCookie(cookies[0])
+	r.AddCookie(&http.Cookie{Name: adminCookie, Value: cookies[0].Value})
+	if isAdmin(r) {
+		t.Error("the session cookie copied as the admin cookie gives the admin rights")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinliming2/LAN-Share/protocol"
+	"github.com/jinliming2/LAN-Share/versions"
+	"nhooyr.io/websocket"
+)
+
+// client is a connected websocket with its own bounded send queue, drained by
+// a writer goroutine so a slow connection never holds up the others.
+type client struct {
+	// session id, shown to clients
+	id       string
+	protocol int
+	// whether the client negotiated the JSON subprotocol
+	json  bool
+	conn  *websocket.Conn
+	queue chan []byte
+
+	// private history key, shared by the sessions of an owner
+	inbox string
+	// may edit and delete the messages of others
+	admin bool
+	// takes the files of the client over after a reconnect
+	resume string
+
+	// shown to the other clients in the room
+	addr   string
+	device string
+	since  time.Time
+
+	mu     sync.Mutex
+	closed bool
+	name   string
+}
+
+const (
+	overflowDropOldest = "drop-oldest"
+	overflowDisconnect = "disconnect"
+
+	closeSendQueueOverflow                        = websocket.StatusPolicyViolation
+	closeUnsupportedProtocol websocket.StatusCode = 4002
+
+	clientIDSize = 12
+)
+
+var (
+	errUnsupportedProtocol = errors.New("unsupported protocol version")
+
+	// messages dropped from full send queues
+	droppedMessages atomic.Uint64
+	// clients disconnected because of a full send queue
+	overflowDisconnects atomic.Uint64
+)
+
+func newClient(c *websocket.Conn, r *http.Request, name string, protocolVersion int) (*client, error) {
+	id, err := randomBytes(clientIDSize)
+	if err != nil {
+		return nil, err
+	}
+	cl := &client{
+		id:       base64.RawURLEncoding.EncodeToString(id),
+		protocol: protocolVersion,
+		json:     c.Subprotocol() == protocol.JSONSubprotocol,
+		conn:     c,
+		queue:    make(chan []byte, *sendQueueSize),
+		addr:     r.RemoteAddr,
+		device:   deviceLabel(r.UserAgent()),
+		since:    time.Now(),
+		name:     name,
+	}
+	cl.inbox = inboxKey(cl.id, r.URL.Query().Get("owner"))
+	cl.admin = isAdmin(r)
+	return cl, nil
+}
+
+// hello returns the frame telling cl what the server supports.
+func (cl *client) hello() []byte {
+	return protocol.EncodeHello(&protocol.Hello{
+		Protocol: cl.protocol,
+		Server:   versions.VERSION,
+		Session:  cl.id,
+		Resume:   cl.resume,
+		Admin:    cl.admin,
+		Epoch:    serverEpoch,
+		Limits: protocol.Limits{
+			Message:     *messageSizeLimit,
+			Name:        maxNameSize,
+			FileName:    maxFileNameSize,
+			HistoryPage: historyPageSize,
+		},
+		Features: map[string]bool{
+			"auth":        authEnabled(),
+			"rooms":       true,
+			"richText":    true,
+			"storage":     fileStorageEnabled(),
+			"persistence": *dataDir != "",
+			"presence":    cl.protocol >= protocol.PresenceVersion,
+			"direct":      cl.protocol >= protocol.DirectVersion,
+			"edit":        cl.protocol >= protocol.EditVersion,
+		},
+	})
+}
+
+// protocolVersion returns the protocol version declared by a client, the
+// first one if it declares none.
+func protocolVersion(declared string) (int, error) {
+	if declared == "" {
+		return protocol.MinVersion, nil
+	}
+	v, err := strconv.Atoi(declared)
+	if err != nil || v < protocol.MinVersion || v > protocol.Version {
+		return 0, errUnsupportedProtocol
+	}
+	return v, nil
+}
+
+// send queues msg without blocking, applying the send-overflow policy if the
+// queue is full.
+func (cl *client) send(msg []byte) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.closed {
+		return
+	}
+	for {
+		select {
+		case cl.queue <- msg:
+			return
+		default:
+		}
+		if *sendOverflow == overflowDisconnect {
+			cl.closed = true
+			overflowDisconnects.Add(1)
+			go cl.conn.Close(closeSendQueueOverflow, "send queue overflow")
+			return
+		}
+		select {
+		case <-cl.queue:
+			droppedMessages.Add(1)
+		default:
+		}
+	}
+}
+
+// run writes the queued messages until ctx is done or a write fails.
+func (cl *client) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-cl.queue:
+			if err := cl.write(ctx, msg); err != nil {
+				if ctx.Err() == nil {
+					log.Println(err)
+				}
+				cl.conn.Close(websocket.StatusInternalError, "write failed")
+				return
+			}
+		}
+	}
+}
+
+// write writes a frame in the format negotiated by cl.
+func (cl *client) write(ctx context.Context, frame []byte) error {
+	frame, ok := protocol.Downgrade(frame, cl.protocol)
+	if !ok {
+		return nil
+	}
+	if !cl.json {
+		return cl.conn.Write(ctx, websocket.MessageBinary, frame)
+	}
+	data, err := protocol.FrameToJSON(frame)
+	if err != nil {
+		return fmt.Errorf("translate frame to JSON: %w", err)
+	}
+	return cl.conn.Write(ctx, websocket.MessageText, data)
+}
+
+// decode decodes and validates a frame sent by cl.
+func (cl *client) decode(data []byte) (*protocol.Message, error) {
+	if cl.json {
+		return protocol.DecodeJSONMessage(data)
+	}
+	return protocol.DecodeMessage(data)
+}
+
+func validSendOverflow(policy string) bool {
+	return policy == overflowDropOldest || policy == overflowDisconnect
+}
+
+// metrics reports the state of the send queues in the Prometheus text format.
+func metrics(w http.ResponseWriter, _ *http.Request) {
+	roomsMu.Lock()
+	var clients, queued, maxDepth int
+	for _, r := range rooms {
+		r.subscribersMu.RLock()
+		for _, cl := range r.subscribers {
+			depth := len(cl.queue)
+			clients++
+			queued += depth
+			if depth > maxDepth {
+				maxDepth = depth
+			}
+		}
+		r.subscribersMu.RUnlock()
+	}
+	roomsMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP lan_share_clients Connected websocket clients.")
+	fmt.Fprintln(w, "# TYPE lan_share_clients gauge")
+	fmt.Fprintln(w, "lan_share_clients", clients)
+	fmt.Fprintln(w, "# HELP lan_share_send_queue_messages Messages waiting in all send queues.")
+	fmt.Fprintln(w, "# TYPE lan_share_send_queue_messages gauge")
+	fmt.Fprintln(w, "lan_share_send_queue_messages", queued)
+	fmt.Fprintln(w, "# HELP lan_share_send_queue_max_depth Messages waiting in the fullest send queue.")
+	fmt.Fprintln(w, "# TYPE lan_share_send_queue_max_depth gauge")
+	fmt.Fprintln(w, "lan_share_send_queue_max_depth", maxDepth)
+	fmt.Fprintln(w, "# HELP lan_share_send_queue_capacity Capacity of each send queue.")
+	fmt.Fprintln(w, "# TYPE lan_share_send_queue_capacity gauge")
+	fmt.Fprintln(w, "lan_share_send_queue_capacity", *sendQueueSize)
+	fmt.Fprintln(w, "# HELP lan_share_send_queue_dropped_total Messages dropped from full send queues.")
+	fmt.Fprintln(w, "# TYPE lan_share_send_queue_dropped_total counter")
+	fmt.Fprintln(w, "lan_share_send_queue_dropped_total", droppedMessages.Load())
+	fmt.Fprintln(w, "# HELP lan_share_send_queue_disconnects_total Clients disconnected because of a full send queue.")
+	fmt.Fprintln(w, "# TYPE lan_share_send_queue_disconnects_total counter")
+	fmt.Fprintln(w, "lan_share_send_queue_disconnects_total", overflowDisconnects.Load())
+	relayMetrics(w)
+}
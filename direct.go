@@ -0,0 +1,133 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+
+	"github.com/jinliming2/LAN-Share/protocol"
+)
+
+var (
+	errNoSession = errors.New("no such session")
+	errNoDirect  = errors.New("session does not get private messages")
+)
+
+// inboxKey returns the private history key of a session. Clients declaring
+// the same owner secret, the devices of one person, share their inbox.
+func inboxKey(session, owner string) string {
+	if owner == "" {
+		return "session:" + session
+	}
+	sum := sha256.Sum256([]byte(owner))
+	return "owner:" + base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// direct relays the chat frame sent by cl to the sessions to, to the other
+// sessions sharing their inboxes and to the sender's, and records it in the
+// private history of those inboxes, which it returns.
+func (r *room) direct(cl *client, to []string, chat []byte) (*list.Element, []string, error) {
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+
+	inboxes := map[string]bool{cl.inbox: true}
+	for _, id := range to {
+		recipient := r.sessionByID(id)
+		if recipient == nil {
+			return nil, nil, errNoSession
+		}
+		if recipient.protocol < protocol.DirectVersion {
+			return nil, nil, errNoDirect
+		}
+		inboxes[recipient.inbox] = true
+	}
+	frame, err := protocol.EncodeDirect(cl.id, to, chat)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([]string, 0, len(inboxes))
+	for inbox := range inboxes {
+		keys = append(keys, inbox)
+	}
+	elem := r.recordPrivate(frame, keys, cl.inbox)
+	for _, sub := range r.subscribers {
+		if inboxes[sub.inbox] {
+			sub.send(frame)
+		}
+	}
+	return elem, keys, nil
+}
+
+// sessionByID returns the subscribed client of a session id, nil if there is
+// none. subscribersMu must be held.
+func (r *room) sessionByID(id string) *client {
+	for _, cl := range r.subscribers {
+		if cl.id == id {
+			return cl
+		}
+	}
+	return nil
+}
+
+// recordPrivate appends a Direct frame sent from the author inbox to the
+// private history of inboxes, evicting their oldest messages beyond the
+// history limits of the room.
+func (r *room) recordPrivate(frame []byte, inboxes []string, author string) *list.Element {
+	r.historyMu.Lock()
+	defer r.historyMu.Unlock()
+
+	elem := r.private.PushBack(&historyEntry{data: frame, inboxes: inboxes, author: author})
+	for _, inbox := range inboxes {
+		r.inboxLen[inbox]++
+		r.inboxBytes[inbox] += len(frame)
+	}
+	for _, inbox := range inboxes {
+		for e := r.private.Front(); e != nil && r.inboxFull(inbox); {
+			next := e.Next()
+			entry := e.Value.(*historyEntry)
+			for i, key := range entry.inboxes {
+				if key == inbox {
+					entry.inboxes = append(entry.inboxes[:i:i], entry.inboxes[i+1:]...)
+					r.dropInbox(inbox, len(entry.data))
+					break
+				}
+			}
+			if len(entry.inboxes) == 0 {
+				entry.removed = true
+				r.private.Remove(e)
+			}
+			e = next
+		}
+	}
+	return elem
+}
+
+func (r *room) inboxFull(inbox string) bool {
+	return r.maxHistory > 0 && r.inboxLen[inbox] > r.maxHistory ||
+		r.maxHistoryBytes > 0 && r.inboxBytes[inbox] > r.maxHistoryBytes
+}
+
+func (r *room) dropInbox(inbox string, size int) {
+	r.inboxLen[inbox]--
+	r.inboxBytes[inbox] -= size
+	if r.inboxLen[inbox] == 0 {
+		delete(r.inboxLen, inbox)
+		delete(r.inboxBytes, inbox)
+	}
+}
+
+// privateHistory returns the Direct frames in the private history of inbox,
+// oldest first.
+func (r *room) privateHistory(inbox string) (msgs [][]byte) {
+	r.historyMu.Lock()
+	defer r.historyMu.Unlock()
+
+	for elem := r.private.Front(); elem != nil; elem = elem.Next() {
+		if entry := elem.Value.(*historyEntry); hasInbox(entry.inboxes, inbox) {
+			msgs = append(msgs, entry.data)
+		}
+	}
+	return
+}
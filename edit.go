@@ -0,0 +1,151 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"log"
+
+	"github.com/jinliming2/LAN-Share/protocol"
+)
+
+var (
+	errNoMessage   = errors.New("no such message")
+	errNotSender   = errors.New("not your message")
+	errNotEditable = errors.New("only text messages can be edited")
+)
+
+// editMessage deletes, leaving a tombstone, or edits the text of the message
+// m.ID on behalf of cl, which has to be its sender or an admin, and sends the
+// new version to the clients which have the message. The file of a deleted
+// file message is cleared.
+func (r *room) editMessage(cl *client, m *protocol.Message) error {
+	former, err := r.replaceMessage(cl, m)
+	if err != nil {
+		return err
+	}
+	if m.Type == protocol.MsgTypeDelete && former.Type == protocol.MsgTypeFile {
+		r.dropFile(former.FileID)
+	}
+	return nil
+}
+
+// replaceMessage replaces the message m.ID by its new version and returns the
+// former one.
+func (r *room) replaceMessage(cl *client, m *protocol.Message) (*protocol.Message, error) {
+	// exclusive so every client gets the update in sequence order
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+	r.historyMu.Lock()
+	defer r.historyMu.Unlock()
+
+	elem := r.findMessage(m.ID)
+	if elem == nil {
+		return nil, errNoMessage
+	}
+	entry := elem.Value.(*historyEntry)
+	if entry.author != cl.inbox && !cl.admin {
+		return nil, errNotSender
+	}
+
+	var chat *protocol.Chat
+	var direct *protocol.Direct
+	var err error
+	if entry.inboxes != nil {
+		if direct, err = protocol.DecodeDirect(entry.data); err != nil {
+			return nil, err
+		}
+		chat = &direct.Chat
+	} else if chat, err = protocol.DecodeChat(entry.data); err != nil {
+		return nil, err
+	}
+	if chat.Type == protocol.MsgTypeDeleted {
+		return nil, errNoMessage
+	}
+
+	former := chat.Message
+	switch m.Type {
+	case protocol.MsgTypeDelete:
+		chat.Message = protocol.Message{Type: protocol.MsgTypeDeleted}
+	case protocol.MsgTypeEdit:
+		if chat.Type != protocol.MsgTypeText && chat.Type != protocol.MsgTypeRichText {
+			return nil, errNotEditable
+		}
+		edit := &protocol.Message{Type: chat.Type, Text: m.Text}
+		if err := normalizeMessage(edit); err != nil {
+			return nil, err
+		}
+		chat.Text = edit.Text
+	}
+	frame, err := protocol.EncodeChat(chat)
+	if err != nil {
+		return nil, err
+	}
+	if direct != nil {
+		if frame, err = protocol.EncodeDirect(direct.From, direct.To, frame); err != nil {
+			return nil, err
+		}
+	}
+	r.replaceHistory(entry, frame)
+
+	// private messages are not numbered, their history is sent whole
+	var update []byte
+	if entry.inboxes == nil {
+		r.seq++
+		entry.revision = r.seq
+		update = protocol.EncodeUpdate(entry.revision, frame)
+	} else {
+		update = protocol.EncodeUpdate(0, frame)
+	}
+	for _, sub := range r.subscribers {
+		if entry.inboxes == nil || hasInbox(entry.inboxes, sub.inbox) {
+			sub.send(update)
+		}
+	}
+	return &former, nil
+}
+
+// findMessage returns the public or private history element of the message
+// with timestamp id, nil if there is none. historyMu must be held.
+func (r *room) findMessage(id int64) *list.Element {
+	for elem := r.history.Back(); elem != nil; elem = elem.Prev() {
+		if protocol.ChatTime(elem.Value.(*historyEntry).data) == id {
+			return elem
+		}
+	}
+	for elem := r.private.Back(); elem != nil; elem = elem.Prev() {
+		if d, err := protocol.DecodeDirect(elem.Value.(*historyEntry).data); err == nil && d.Time == id {
+			return elem
+		}
+	}
+	return nil
+}
+
+// replaceHistory replaces the data of entry by its new version, in the store
+// too. historyMu must be held.
+func (r *room) replaceHistory(entry *historyEntry, data []byte) {
+	if entry.inboxes != nil {
+		for _, inbox := range entry.inboxes {
+			r.inboxBytes[inbox] += len(data) - len(entry.data)
+		}
+		entry.data = data
+		return
+	}
+	r.historyBytes += len(data) - len(entry.data)
+	r.historyTypeBytes[protocol.ChatType(entry.data)] -= len(entry.data)
+	r.historyTypeBytes[protocol.ChatType(data)] += len(data)
+	entry.data = data
+	if entry.id != 0 && r.historyStorage != nil {
+		if err := r.historyStorage.Replace(entry.id, encodeHistoryRecord(entry.author, data)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func hasInbox(inboxes []string, inbox string) bool {
+	for _, key := range inboxes {
+		if key == inbox {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinliming2/LAN-Share/protocol"
+)
+
+type storedFile struct {
+	path        string
+	name        string
+	contentType string
+	size        int64
+	etag        string
+	modTime     time.Time
+	expire      time.Time
+	room        *room
+	msgObj      *list.Element
+}
+
+var (
+	fileStorageDir string
+
+	storedFiles   = make(map[uint32]*storedFile)
+	storedBytes   int64 // including the bytes reserved by uploads in progress
+	storedFilesMu = sync.RWMutex{}
+
+	errQuotaExceeded = errors.New("file storage quota exceeded")
+)
+
+// fileStorageSubdir is the directory the hosted files are kept in, within
+// the one given by the operator, so that only it is ever cleared.
+const fileStorageSubdir = "lan-share-files"
+
+// initFileStorage enables the server-hosted file storage in dir. Files left
+// by a previous run are dropped, their messages are gone along with it.
+func initFileStorage(dir string) error {
+	dir = filepath.Join(dir, fileStorageSubdir)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	fileStorageDir = dir
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			expireStoredFiles(time.Now())
+		}
+	}()
+	return nil
+}
+
+func fileStorageEnabled() bool {
+	return fileStorageDir != ""
+}
+
+func reserveStorage(size int64) error {
+	storedFilesMu.Lock()
+	defer storedFilesMu.Unlock()
+	if storedBytes+size > *fileQuota {
+		return errQuotaExceeded
+	}
+	storedBytes += size
+	return nil
+}
+
+func releaseStorage(size int64) {
+	storedFilesMu.Lock()
+	defer storedFilesMu.Unlock()
+	storedBytes -= size
+}
+
+// storeFile saves the request body as the content of file id.
+func storeFile(id uint32, w http.ResponseWriter, r *http.Request) {
+	if !fileStorageEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	if _, ok := fileSender(id, r.URL.Query().Get("secret")); !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.ContentLength < 0 {
+		http.Error(w, "Length Required", http.StatusLengthRequired)
+		return
+	}
+
+	storedFilesMu.RLock()
+	_, exists := storedFiles[id]
+	storedFilesMu.RUnlock()
+	if exists {
+		http.Error(w, "file already stored", http.StatusConflict)
+		return
+	}
+
+	if err := reserveStorage(r.ContentLength); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	stored := false
+	defer func() {
+		if !stored {
+			releaseStorage(r.ContentLength)
+		}
+	}()
+
+	// large files take longer than the server wide timeout
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+
+	path := filepath.Join(fileStorageDir, strconv.FormatUint(uint64(id), 10))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(r.Body, r.ContentLength+1))
+	if err == nil && n != r.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := truncateUTF8(strings.TrimSpace(printable(r.URL.Query().Get("name"))), maxFileNameSize)
+	if name == "" {
+		name = strconv.FormatUint(uint64(id), 10)
+	}
+	contentType := r.URL.Query().Get("type")
+	if !validMIME(contentType) {
+		contentType = "application/octet-stream"
+	}
+	now := time.Now()
+
+	storedFilesMu.Lock()
+	storedFiles[id] = &storedFile{
+		path:        path,
+		name:        name,
+		contentType: contentType,
+		size:        n,
+		etag:        `"` + hex.EncodeToString(hash.Sum(nil)) + `"`,
+		modTime:     now,
+		expire:      now.Add(*fileExpire),
+	}
+	storedFilesMu.Unlock()
+	stored = true
+	keepFileGrant(id)
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// attachStoredFile binds the file message published in room to the stored
+// file, and reports whether id is a stored file at all.
+func attachStoredFile(room *room, id uint32, msgObj *list.Element) bool {
+	storedFilesMu.Lock()
+	defer storedFilesMu.Unlock()
+
+	f, ok := storedFiles[id]
+	if !ok {
+		return false
+	}
+	f.room = room
+	f.msgObj = msgObj
+	return true
+}
+
+// serveStoredFile serves file id from disk, and reports whether id is a
+// stored file at all.
+func serveStoredFile(id uint32, w http.ResponseWriter, r *http.Request) bool {
+	storedFilesMu.RLock()
+	f, ok := storedFiles[id]
+	storedFilesMu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	content, err := os.Open(f.path)
+	if err != nil {
+		http.NotFound(w, r)
+		return true
+	}
+	defer content.Close()
+
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", f.contentType)
+	w.Header().Set("Content-Disposition", contentDisposition(r, f.name))
+	w.Header().Set("ETag", f.etag)
+	http.ServeContent(w, r, f.name, f.modTime, content)
+	return true
+}
+
+// dropStoredFile removes stored file id, releasing its share of the quota.
+func dropStoredFile(id uint32) {
+	storedFilesMu.Lock()
+	defer storedFilesMu.Unlock()
+	if f, ok := storedFiles[id]; ok {
+		deleteStoredFile(id, f)
+	}
+}
+
+// deleteStoredFile removes f, stored as id. storedFilesMu must be held.
+func deleteStoredFile(id uint32, f *storedFile) {
+	if err := os.Remove(f.path); err != nil {
+		log.Println(err)
+	}
+	storedBytes -= f.size
+	delete(storedFiles, id)
+}
+
+func expireStoredFiles(now time.Time) {
+	storedFilesMu.Lock()
+	defer storedFilesMu.Unlock()
+
+	cleared := make(map[*room][]uint32)
+	for id, f := range storedFiles {
+		if now.Before(f.expire) {
+			continue
+		}
+		deleteStoredFile(id, f)
+		revokeFileGrant(id)
+		if f.room == nil {
+			continue
+		}
+		f.room.forgetHistory(f.msgObj)
+		cleared[f.room] = append(cleared[f.room], id)
+	}
+
+	for room, ids := range cleared {
+		room.publish(protocol.EncodeClearFile(ids...))
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
-	"bufio"
 	"container/list"
 	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
@@ -12,216 +14,394 @@ import (
 	"sync"
 	"time"
 
+	"github.com/jinliming2/LAN-Share/protocol"
 	"nhooyr.io/websocket"
 )
 
-type fileReceiver struct {
-	w          http.ResponseWriter
-	r          *http.Request
-	cancelWait func()
-	done       chan bool
+// fileGrant holds the capabilities issued along with a file id: the token in
+// its download URL, and the secret proving who offers it.
+type fileGrant struct {
+	token  string
+	secret string
+	issued time.Time
+	// the connection offering the file, nil until the file message is sent
+	sender *websocket.Conn
+	// the metadata sent along, downloads are answered from
+	info *fileInfo
+	// the private history keys of the recipients and sender of a file sent
+	// privately, nil if anyone may download it
+	inboxes []string
 }
 
+const (
+	fileTokenSize = 16
+	// how long an issued id may stay unclaimed by a file message
+	fileGrantTimeout = time.Hour
+)
+
 var (
-	fileCounter   uint32 = 0
-	fileCounterMu        = sync.Mutex{}
+	fileGrants   = make(map[uint32]*fileGrant)
+	fileTokens   = make(map[string]uint32)
+	fileGrantsMu = sync.RWMutex{}
+
+	// ids are issued in sequence, paired with serverEpoch
+	fileCounter uint32
 
-	file2Subscriber  = make(map[*websocket.Conn]map[uint32]*list.Element)
-	id2File          = make(map[uint32]*websocket.Conn)
-	fileSubscriberMu = sync.RWMutex{}
+	errUnknownFile = errors.New("unknown file id")
+	errFileClaimed = errors.New("file id already claimed")
+	errStaleFile   = errors.New("file id issued by a previous server instance")
 
-	pendingTransfer   = make(map[uint32]*list.List)
-	pendingTransferMu = sync.RWMutex{}
+	// the room every relayed file is shared in
+	fileRooms   = make(map[uint32]*room)
+	fileRoomsMu = sync.RWMutex{}
 )
 
-func getFileId() (id uint32) {
-	fileCounterMu.Lock()
-	defer fileCounterMu.Unlock()
-	id = fileCounter
-	fileCounter++
-	return
+func init() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			expireFileGrants(time.Now())
+		}
+	}()
 }
 
-func newFile(subscriber *websocket.Conn, id uint32, msgObj *list.Element) {
-	fileSubscriberMu.Lock()
-	defer fileSubscriberMu.Unlock()
+// getFileId issues the next file id along with its download token and the
+// secret its sender has to present. The id is unique along with serverEpoch.
+func getFileId() (uint32, *fileGrant, error) {
+	token, err := randomBytes(fileTokenSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	secret, err := randomBytes(fileTokenSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	grant := &fileGrant{
+		token:  base64.RawURLEncoding.EncodeToString(token),
+		secret: base64.RawURLEncoding.EncodeToString(secret),
+		issued: time.Now(),
+	}
+
+	fileGrantsMu.Lock()
+	defer fileGrantsMu.Unlock()
+	for {
+		fileCounter++
+		id := fileCounter
+		// skip the ids still in use once the counter wraps around
+		if _, ok := fileGrants[id]; ok || id == 0 {
+			continue
+		}
+		fileGrants[id] = grant
+		fileTokens[grant.token] = id
+		return id, grant, nil
+	}
+}
 
-	if _, ok := file2Subscriber[subscriber]; !ok {
-		file2Subscriber[subscriber] = make(map[uint32]*list.Element)
+// fileSender checks secret against the one issued with file id, and returns
+// the connection which claimed the file, if any.
+func fileSender(id uint32, secret string) (*websocket.Conn, bool) {
+	fileGrantsMu.RLock()
+	defer fileGrantsMu.RUnlock()
+	grant, ok := fileGrants[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(secret), []byte(grant.secret)) != 1 {
+		return nil, false
 	}
-	file2Subscriber[subscriber][id] = msgObj
-	id2File[id] = subscriber
+	return grant.sender, true
 }
 
-func clearFile(subscriber *websocket.Conn) {
-	fileSubscriberMu.Lock()
-	defer fileSubscriberMu.Unlock()
-	pendingTransferMu.Lock()
-	defer pendingTransferMu.Unlock()
+// fileByToken returns the id of the file downloaded with token.
+func fileByToken(token string) (uint32, bool) {
+	fileGrantsMu.RLock()
+	defer fileGrantsMu.RUnlock()
+	id, ok := fileTokens[token]
+	return id, ok
+}
 
-	clearFileMsg := []byte{byte(MsgTypeClearFile)}
+// claimFile binds the file offered by m to sender, which has to know the
+// secret issued with its id, and replaces the secret in the file info by the
+// download token.
+func claimFile(sender *websocket.Conn, m *protocol.Message) error {
+	var info fileInfo
+	if err := json.Unmarshal(m.FileInfo, &info); err != nil {
+		return errBadFileInfo
+	}
+	if info.Epoch != serverEpoch {
+		return errStaleFile
+	}
 
-	if subList, ok := file2Subscriber[subscriber]; ok {
-		for id, msgObj := range subList {
-			delete(id2File, id)
-			history.Remove(msgObj)
-			idByte := uint32ToBytes(id)
-			clearFileMsg = append(clearFileMsg, idByte[:]...)
-			if l, ok := pendingTransfer[id]; ok {
-				for item := l.Front(); item != nil; item = item.Next() {
-					r := item.Value.(*fileReceiver)
-					r.cancelWait()
-					http.NotFound(r.w, r.r)
-					r.done <- true
-				}
-				delete(pendingTransfer, id)
-			}
-		}
+	fileGrantsMu.Lock()
+	defer fileGrantsMu.Unlock()
+	grant, ok := fileGrants[m.FileID]
+	if !ok || subtle.ConstantTimeCompare([]byte(info.Secret), []byte(grant.secret)) != 1 {
+		return errUnknownFile
+	}
+	if grant.sender != nil {
+		return errFileClaimed
 	}
 
-	publish(context.Background(), clearFileMsg, false)
+	info.Secret = ""
+	info.Token = grant.token
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	grant.sender = sender
+	grant.info = &info
+	m.FileInfo = data
+	return nil
 }
 
-func requestFile(id uint32, w http.ResponseWriter, r *http.Request) {
-	fileSubscriberMu.RLock()
-	subscriber, ok := id2File[id]
-	fileSubscriberMu.RUnlock()
-	if !ok {
-		http.NotFound(w, r)
-		return
+// claimedFileInfo returns the metadata of the claimed file id.
+func claimedFileInfo(id uint32) (*fileInfo, bool) {
+	fileGrantsMu.RLock()
+	defer fileGrantsMu.RUnlock()
+	grant, ok := fileGrants[id]
+	if !ok || grant.info == nil {
+		return nil, false
 	}
+	return grant.info, true
+}
+
+// currentEpoch tells if epoch, which a client pairs a file id with, is the one
+// of this server instance.
+func currentEpoch(epoch string) bool {
+	e, err := strconv.ParseUint(epoch, 10, 32)
+	return err == nil && uint32(e) == serverEpoch
+}
 
-	ctx, cancelWait := context.WithTimeout(r.Context(), 5*time.Second)
+// restrictFileGrant limits the downloads of file id to inboxes.
+func restrictFileGrant(id uint32, inboxes []string) {
+	fileGrantsMu.Lock()
+	defer fileGrantsMu.Unlock()
+	if grant, ok := fileGrants[id]; ok {
+		grant.inboxes = inboxes
+	}
+}
 
-	pendingTransferMu.Lock()
-	if _, ok := pendingTransfer[id]; !ok {
-		pendingTransfer[id] = list.New()
+// mayDownload tells if the download r of file id is allowed: a file sent
+// privately is only served to the inboxes it was sent to, which prove it by
+// their owner secret, or by the resume token of a session without one.
+func mayDownload(id uint32, r *http.Request) bool {
+	fileGrantsMu.RLock()
+	var inboxes []string
+	if grant, ok := fileGrants[id]; ok {
+		inboxes = grant.inboxes
 	}
-	done := make(chan bool, 1)
-	item := &fileReceiver{
-		w,
-		r,
-		cancelWait,
-		done,
+	fileGrantsMu.RUnlock()
+	if inboxes == nil {
+		return true
 	}
-	elem := pendingTransfer[id].PushBack(item)
-	pendingTransferMu.Unlock()
+	if owner := r.URL.Query().Get("owner"); owner != "" {
+		return hasInbox(inboxes, inboxKey("", owner))
+	}
+	inbox, ok := resumedInbox(r.URL.Query().Get("resume"))
+	return ok && hasInbox(inboxes, inbox)
+}
 
-	requestRange := r.Header.Get("Range")
-	msg := make([]byte, 1+4+len(requestRange))
-	idByte := uint32ToBytes(id)
-	msg[0] = byte(MsgTypeRequestFile)
-	copy(msg[1:], idByte[:])
-	if len(requestRange) > 0 {
-		copy(msg[5:], []byte(requestRange))
+// keepFileGrant postpones the expiry of the unclaimed grant of file id.
+func keepFileGrant(id uint32) {
+	fileGrantsMu.Lock()
+	defer fileGrantsMu.Unlock()
+	if grant, ok := fileGrants[id]; ok {
+		grant.issued = time.Now()
 	}
-	subscriber.Write(ctx, websocket.MessageBinary, msg)
+}
 
-	<-ctx.Done()
-	if ctx.Err() == context.DeadlineExceeded {
-		http.Error(w, "Request Timeout", http.StatusRequestTimeout)
-	} else {
-		<-done
+func revokeFileGrant(id uint32) {
+	fileGrantsMu.Lock()
+	defer fileGrantsMu.Unlock()
+	if grant, ok := fileGrants[id]; ok {
+		delete(fileTokens, grant.token)
+		delete(fileGrants, id)
 	}
+}
 
-	pendingTransferMu.Lock()
-	defer pendingTransferMu.Unlock()
-	pendingTransfer[id].Remove(elem)
+func expireFileGrants(now time.Time) {
+	fileGrantsMu.Lock()
+	defer fileGrantsMu.Unlock()
+	for id, grant := range fileGrants {
+		if grant.sender == nil && now.Sub(grant.issued) > fileGrantTimeout {
+			delete(fileTokens, grant.token)
+			delete(fileGrants, id)
+		}
+	}
 }
 
-func uploadFile(id uint32, w http.ResponseWriter, r *http.Request) {
-	pendingTransferMu.RLock()
+func (r *room) newFile(subscriber *websocket.Conn, id uint32, msgObj *list.Element) {
+	r.fileSubscriberMu.Lock()
+	defer r.fileSubscriberMu.Unlock()
 
-	l, ok := pendingTransfer[id]
-	if !ok || l.Len() == 0 {
-		pendingTransferMu.RUnlock()
-		http.NotFound(w, r)
-		return
+	if _, ok := r.file2Subscriber[subscriber]; !ok {
+		r.file2Subscriber[subscriber] = make(map[uint32]*list.Element)
 	}
+	r.file2Subscriber[subscriber][id] = msgObj
+	r.id2File[id] = subscriber
+
+	fileRoomsMu.Lock()
+	defer fileRoomsMu.Unlock()
+	fileRooms[id] = r
+}
 
-	requestRange := r.URL.Query().Get("range")
-	name := strings.ReplaceAll(r.URL.Query().Get("name"), `"`, `\"`)
-	size := r.URL.Query().Get("size")
-	contentType := r.URL.Query().Get("type")
-	contentRange := r.Header.Get("Content-Range")
+func (r *room) clearFile(subscriber *websocket.Conn) {
+	r.fileSubscriberMu.Lock()
+	defer r.fileSubscriberMu.Unlock()
+	fileRoomsMu.Lock()
+	defer fileRoomsMu.Unlock()
+	relaysMu.Lock()
+	defer relaysMu.Unlock()
 
-	if name == "" {
-		name = strconv.Itoa(int(id))
+	var cleared []uint32
+	if subList, ok := r.file2Subscriber[subscriber]; ok {
+		for id, msgObj := range subList {
+			delete(r.id2File, id)
+			delete(fileRooms, id)
+			revokeFileGrant(id)
+			r.forgetHistory(msgObj)
+			cleared = append(cleared, id)
+			dropRelays(id)
+		}
+		delete(r.file2Subscriber, subscriber)
 	}
-	if contentType == "" {
-		contentType = "application/octet-stream"
+
+	if len(cleared) > 0 {
+		r.publish(protocol.EncodeClearFile(cleared...))
 	}
+}
 
-	receiver := make([]io.Writer, 0, l.Len())
-	done := make([]chan bool, 0, l.Len())
-	for item := l.Front(); item != nil; item = item.Next() {
-		r := item.Value.(*fileReceiver)
-		if r.r.Header.Get("Range") != requestRange {
-			continue
-		}
-		r.cancelWait()
-		receiver = append(receiver, r.w.(io.Writer))
-		done = append(done, r.done)
-		r.w.Header().Set("Content-Type", contentType)
-		method := "attachment"
-		if r.r.URL.Query().Has("open") {
-			method = "inline"
-		}
-		r.w.Header().Set("Content-Disposition", method+`; filename="`+name+`"`)
-		if size != "" {
-			r.w.Header().Set("Content-Length", size)
-		}
-		if contentRange != "" {
-			r.w.Header().Set("Content-Range", contentRange)
-		}
-		r.w.WriteHeader(http.StatusPartialContent)
+// dropFile clears file id, offered in r, whose message is deleted: it is no
+// longer relayed nor stored.
+func (r *room) dropFile(id uint32) {
+	r.fileSubscriberMu.Lock()
+	fileRoomsMu.Lock()
+	relaysMu.Lock()
+	if subscriber, ok := r.id2File[id]; ok {
+		delete(r.file2Subscriber[subscriber], id)
+		delete(r.id2File, id)
 	}
+	delete(fileRooms, id)
+	dropRelays(id)
+	relaysMu.Unlock()
+	fileRoomsMu.Unlock()
+	r.fileSubscriberMu.Unlock()
 
-	pendingTransferMu.RUnlock()
+	revokeFileGrant(id)
+	dropStoredFile(id)
+	r.publish(protocol.EncodeClearFile(id))
+}
 
-	defer func() {
-		for _, d := range done {
-			d <- true
+func requestFile(id uint32, w http.ResponseWriter, r *http.Request) {
+	info, ok := claimedFileInfo(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	plan, err := newRangePlan(r.Header.Get("Range"), info)
+	if err != nil {
+		unsatisfiable(w, info.Size)
+		return
+	}
+	if r.Method == http.MethodHead {
+		resumptionsMu.Lock()
+		_, ok := relaySource(id)
+		resumptionsMu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
 		}
-	}()
-
-	writer := newMultiWriterIgnoreError(receiver...)
-	if _, err := bufio.NewReader(r.Body).WriteTo(writer); err != nil {
-		http.Error(w, err.Error(), http.StatusAccepted)
+		plan.writeHeader(w, r)
 		return
 	}
-}
 
-type multiWriterIgnoreError struct {
-	writers []io.Writer
-	errors  map[int]interface{}
-}
+	// large files take longer than the server wide timeout, and so may the wait
+	// for the sender to reconnect
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	spans := plan.spans()
+	rl, rd, err := awaitRelay(r.Context(), id, spans[0], info.Size)
+	if err == context.DeadlineExceeded {
+		http.Error(w, "Request Timeout", http.StatusRequestTimeout)
+		return
+	} else if err != nil {
+		http.NotFound(w, r)
+		return
+	}
 
-func newMultiWriterIgnoreError(writers ...io.Writer) io.Writer {
-	return &multiWriterIgnoreError{
-		writers: writers,
-		errors:  make(map[int]interface{}),
+	dl := &relayedDownload{file: id, addr: r.RemoteAddr, since: time.Now()}
+	defer dl.track()()
+	plan.writeHeader(w, r)
+	body := plan.body(w)
+	for i, span := range spans {
+		if i > 0 {
+			if rl, rd, err = awaitRelay(r.Context(), id, span, info.Size); err != nil {
+				return
+			}
+			body.skip(span.start)
+		}
+		if err := sendSpan(r.Context(), id, span, info.Size, rl, rd, body, dl); err != nil {
+			return
+		}
 	}
+	body.Close()
 }
 
-func (mwie *multiWriterIgnoreError) Write(p []byte) (n int, err error) {
-	for i, w := range mwie.writers {
-		if _, ok := mwie.errors[i]; ok {
+// sendSpan writes span of file id to body from rl, which rd is registered
+// to, and leaves it. A download falling too far behind the others is moved
+// to an upload of its own.
+func sendSpan(ctx context.Context, id uint32, span httpRange, size int64, rl *relay, rd *relayReader, body io.Writer, dl *relayedDownload) error {
+	defer func() {
+		if rl != nil {
+			rl.leave(rd)
+		}
+	}()
+	for pos := span.start; pos < span.end; {
+		chunk, err := rl.read(ctx, rd)
+		if err == errEvicted {
+			// fell too far behind the others, the rest is uploaded again
+			rl.leave(rd)
+			if rl, rd, err = awaitRelay(ctx, id, httpRange{pos, span.end}, size); err != nil {
+				return err
+			}
 			continue
 		}
-
-		n, err = w.Write(p)
 		if err != nil {
-			mwie.errors[i] = nil
-			continue
+			return err
 		}
-		if n != len(p) {
-			mwie.errors[i] = nil
-			continue
+		if n := span.end - pos; int64(len(chunk)) > n {
+			chunk = chunk[:n]
 		}
+		if _, err := body.Write(chunk); err != nil {
+			return err
+		}
+		pos += int64(len(chunk))
+		dl.sent.Add(int64(len(chunk)))
+		rl.advance(rd, pos)
 	}
-	if len(mwie.errors) == len(mwie.writers) {
-		return 0, errors.New("failed to write")
+	return nil
+}
+
+func uploadFile(id uint32, w http.ResponseWriter, r *http.Request) {
+	// only the connection offering the file may feed its receivers
+	if sender, ok := fileSender(id, r.URL.Query().Get("secret")); !ok || sender == nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	rl := startRelay(id, r.URL.Query().Get("range"))
+	if rl == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// large files take longer than the server wide timeout
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+	if err := rl.fill(r.Context(), r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusAccepted)
+	}
+}
+
+func contentDisposition(r *http.Request, name string) string {
+	method := "attachment"
+	if r.URL.Query().Has("open") {
+		method = "inline"
 	}
-	return len(p), nil
+	return method + `; filename="` + strings.ReplaceAll(name, `"`, `\"`) + `"`
 }
@@ -1,8 +1,7 @@
 module github.com/jinliming2/LAN-Share
 
-go 1.17
+go 1.20
 
-require (
-	github.com/klauspost/compress v1.10.3 // indirect
-	nhooyr.io/websocket v1.8.7 // indirect
-)
+require nhooyr.io/websocket v1.8.7
+
+require github.com/klauspost/compress v1.10.3 // indirect
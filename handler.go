@@ -1,31 +1,64 @@
 package main
 
 import (
+	"container/list"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"image/png"
 	"log"
 	"math"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/jinliming2/LAN-Share/protocol"
 	"nhooyr.io/websocket"
 )
 
+const (
+	// messages sent on connect, and per history API request by default
+	historyPageSize    = 50
+	maxHistoryPageSize = 500
+
+	// bytes allowed in a JSON frame besides its base64 encoded content
+	jsonFrameOverhead = 4096
+)
+
 var (
 	HTTPHandler = http.NewServeMux()
 
-	idMatcher, _ = regexp.Compile(`/(\d+)$`)
+	idMatcher, _    = regexp.Compile(`/(\d+)$`)
+	tokenMatcher, _ = regexp.Compile(`/([A-Za-z0-9_-]+)$`)
+
+	lastNow   int64 = 0
+	lastNowMu       = sync.Mutex{}
+
+	// websockets are hijacked, so http.Server.Shutdown neither closes nor
+	// waits for them
+	websocketsMu      sync.Mutex
+	websocketsClosing = make(chan struct{})
+	websocketHandlers sync.WaitGroup
 )
 
 func init() {
 	HTTPHandler.Handle("/", http.HandlerFunc(index))
 	HTTPHandler.Handle("/id", http.HandlerFunc(id))
 	HTTPHandler.Handle("/upload/", http.HandlerFunc(upload))
+	HTTPHandler.Handle("/store/", http.HandlerFunc(store))
 	HTTPHandler.Handle("/download/", http.HandlerFunc(download))
 	HTTPHandler.Handle("/ws", http.HandlerFunc(ws))
+	HTTPHandler.Handle("/rooms", http.HandlerFunc(roomList))
+	HTTPHandler.Handle("/qr", http.HandlerFunc(qrImage))
+	HTTPHandler.Handle("/login", http.HandlerFunc(login))
+	HTTPHandler.Handle("/logout", http.HandlerFunc(logout))
+	HTTPHandler.Handle("/admin", http.HandlerFunc(adminLogin))
+	HTTPHandler.Handle("/metrics", http.HandlerFunc(metrics))
+	HTTPHandler.Handle("/api/history", http.HandlerFunc(historyAPI))
 }
 
 func index(w http.ResponseWriter, r *http.Request) {
@@ -36,11 +69,95 @@ func index(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func id(w http.ResponseWriter, _ *http.Request) {
-	ID := getFileId()
+func id(w http.ResponseWriter, r *http.Request) {
+	ID, grant, err := getFileId()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	json.NewEncoder(w).Encode(struct {
-		ID uint32 `json:"id"`
-	}{ID})
+		ID     uint32 `json:"id"`
+		Epoch  uint32 `json:"epoch"`
+		Token  string `json:"token"`
+		Secret string `json:"secret"`
+		Store  bool   `json:"store"`
+	}{ID, serverEpoch, grant.token, grant.secret, fileStorageEnabled()})
+}
+
+func qrImage(w http.ResponseWriter, r *http.Request) {
+	if shareURL == "" {
+		http.NotFound(w, r)
+		return
+	}
+	code, err := encodeQR([]byte(shareURL))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("format") == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		code.WriteSVG(w)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	png.Encode(w, code.Image(8))
+}
+
+func roomList(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listRooms())
+}
+
+// historyAPI serves a page of the history of a room older than the sequence
+// number before, as the frames sent over the websocket, each one prefixed by
+// its 4-byte big-endian length.
+func historyAPI(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	room, err := findRoom(query.Get("room"), query.Get("password"))
+	if err == errWrongRoomPassword {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	before := uint64(math.MaxUint64)
+	if query.Has("before") {
+		if before, err = strconv.ParseUint(query.Get("before"), 10, 64); err != nil {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := historyPageSize
+	if query.Has("limit") {
+		if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit < 1 || limit > maxHistoryPageSize {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page := room.historyPage(before, limit)
+	w.Header().Set("Cache-Control", "no-store")
+	if query.Get("format") == "json" {
+		frames := make([]json.RawMessage, 0, len(page))
+		for _, msg := range page {
+			frame, err := protocol.FrameToJSON(msg)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			frames = append(frames, frame)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(frames)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	for _, msg := range page {
+		w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(msg))))
+		w.Write(msg)
+	}
 }
 
 func upload(w http.ResponseWriter, r *http.Request) {
@@ -53,128 +170,278 @@ func upload(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	id, err := strconv.ParseInt(match[1], 10, 32)
+	id, err := strconv.ParseUint(match[1], 10, 32)
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
+	if !currentEpoch(r.URL.Query().Get("epoch")) {
+		http.Error(w, errStaleFile.Error(), http.StatusGone)
+		return
+	}
 	uploadFile(uint32(id), w, r)
 }
 
-func download(w http.ResponseWriter, r *http.Request) {
+func store(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only support POST", http.StatusMethodNotAllowed)
+		return
+	}
 	match := idMatcher.FindStringSubmatch(r.URL.Path)
 	if len(match) != 2 {
 		http.NotFound(w, r)
 		return
 	}
-	id, err := strconv.ParseInt(match[1], 10, 32)
+	id, err := strconv.ParseUint(match[1], 10, 32)
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
-	requestFile(uint32(id), w, r)
+	if !currentEpoch(r.URL.Query().Get("epoch")) {
+		http.Error(w, errStaleFile.Error(), http.StatusGone)
+		return
+	}
+	storeFile(uint32(id), w, r)
+}
+
+func download(w http.ResponseWriter, r *http.Request) {
+	match := tokenMatcher.FindStringSubmatch(r.URL.Path)
+	if len(match) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	id, ok := fileByToken(match[1])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !mayDownload(id, r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if serveStoredFile(id, w, r) {
+		return
+	}
+	requestFile(id, w, r)
 }
 
 func ws(w http.ResponseWriter, r *http.Request) {
-	c, err := websocket.Accept(w, r, nil)
+	if !trackWebsocket() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer websocketHandlers.Done()
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{protocol.JSONSubprotocol}})
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	defer c.Close(websocket.StatusInternalError, "unhandled server error")
-	c.SetReadLimit(int64(*messageSizeLimit))
-
-	name := r.URL.Query().Get("name")
-	if name == "" {
-		name = r.RemoteAddr
+	if c.Subprotocol() == protocol.JSONSubprotocol {
+		// leave room for base64 encoded images and the JSON around them
+		c.SetReadLimit(int64(*messageSizeLimit)/3*4 + jsonFrameOverhead)
+	} else {
+		c.SetReadLimit(int64(*messageSizeLimit))
 	}
-	nameLen := byte(len(name))
-	byteName := []byte(name[:nameLen])
 
-	addSubscriber(c)
-	defer delSubscriber(c)
-	defer clearFile(c)
+	name := sanitizeName(r.URL.Query().Get("name"), r.RemoteAddr)
+
+	query := r.URL.Query()
+	version, err := protocolVersion(query.Get("protocol"))
+	if err != nil {
+		c.Close(closeUnsupportedProtocol, err.Error())
+		return
+	}
+	cl, err := newClient(c, r, name, version)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	room, err := joinRoom(cl, query.Get("room"), query.Get("password"), query.Has("hidden"))
+	if err != nil {
+		c.Close(roomCloseStatus(err), err.Error())
+		return
+	}
+	defer leaveRoom(room, c)
+	if cl.resume, err = room.resume(cl, query.Get("resume")); err != nil {
+		log.Println(err)
+		return
+	}
+	// set when the client closes the connection itself, leaving the page
+	var left atomic.Bool
+	defer func() { room.suspend(cl, left.Load()) }()
 
 	ctx, close := context.WithCancel(r.Context())
+	go func() {
+		select {
+		case <-websocketsClosing:
+			c.Close(websocket.StatusGoingAway, "server is shutting down")
+			close()
+		case <-ctx.Done():
+		}
+	}()
 
-	his := history.Front()
-	for his != nil {
-		c.Write(ctx, websocket.MessageBinary, his.Value.([]byte))
-		his = his.Next()
+	// messages published meanwhile wait in the queue until the history is
+	// sent, the client skips the ones it gets twice by their sequence number
+	since, err := strconv.ParseUint(query.Get("since"), 10, 64)
+	resume := err == nil
+	epoch, err := strconv.ParseUint(query.Get("epoch"), 10, 32)
+	resume = resume && err == nil
+	notice, missing := room.historySince(uint32(epoch), since, resume, historyPageSize)
+	missing = append(missing, room.privateHistory(cl.inbox)...)
+	for _, his := range append([][]byte{cl.hello(), notice}, missing...) {
+		if err := cl.write(ctx, his); err != nil {
+			close()
+			break
+		}
 	}
+	go cl.run(ctx)
 
+	websocketHandlers.Add(1)
 	go func() {
+		defer websocketHandlers.Done()
 		for {
 			_, data, err := c.Read(ctx)
 			if err != nil {
-				if !(websocket.CloseStatus(err) == websocket.StatusNormalClosure || websocket.CloseStatus(err) == websocket.StatusGoingAway) {
+				if websocket.CloseStatus(err) == websocket.StatusNormalClosure || websocket.CloseStatus(err) == websocket.StatusGoingAway {
+					left.Store(true)
+				} else {
 					log.Println(err)
 				}
 				close()
 				return
 			}
 
-			msg := make([]byte, 1+int(nameLen)+8+len(data))
-
-			offset := 0
-			msg[offset] = data[0]
-			offset++
-			msg[offset] = nameLen
-			offset++
-			copy(msg[offset:], byteName)
-			offset += int(nameLen)
-			now := dateNow()
-			copy(msg[offset:], now[:])
-			offset += len(now)
-
-			mt := MsgType(data[0])
-
-			switch mt {
-			case MsgTypeFile:
-				idByte := data[1:5]
-				var id uint32 = 0
-				for i := 3; i >= 0; i-- {
-					id += uint32(idByte[i]) * uint32(math.Pow(2, float64((3-i)*8)))
+			m, err := cl.decode(data)
+			if err != nil {
+				cl.send(protocol.EncodeError(protocol.ErrorCodeOf(err), err.Error()))
+				continue
+			}
+			if m.Type == protocol.MsgTypeRename {
+				if err := room.rename(cl, m.Text); err != nil {
+					cl.send(protocol.EncodeError(protocol.ErrorInvalidContent, err.Error()))
+				}
+				continue
+			}
+			if m.Type == protocol.MsgTypeDelete || m.Type == protocol.MsgTypeEdit {
+				if err := room.editMessage(cl, m); err != nil {
+					code := protocol.ErrorInvalidContent
+					if err == errNotSender {
+						code = protocol.ErrorForbidden
+					}
+					cl.send(protocol.EncodeError(code, err.Error()))
+				}
+				continue
+			}
+			if err := normalizeMessage(m); err != nil {
+				cl.send(protocol.EncodeError(protocol.ErrorInvalidContent, err.Error()))
+				continue
+			}
+			if m.Type == protocol.MsgTypeFile {
+				if err := claimFile(c, m); err != nil {
+					cl.send(protocol.EncodeError(protocol.ErrorForbidden, err.Error()))
+					continue
 				}
-				copy(msg[offset:], data[1:])
+			}
 
-				msgObj := publish(ctx, msg, true)
-				newFile(c, id, msgObj)
-			default:
-				copy(msg[offset:], data[1:])
-				publish(ctx, msg, true)
+			// the sequence number is set once published
+			msg, err := protocol.EncodeChat(&protocol.Chat{Message: *m, Name: cl.session().Name, Time: dateNow()})
+			if err != nil {
+				cl.send(protocol.EncodeError(protocol.ErrorInvalidContent, err.Error()))
+				continue
+			}
+			var msgObj *list.Element
+			if m.To != nil {
+				var inboxes []string
+				if msgObj, inboxes, err = room.direct(cl, m.To, msg); err != nil {
+					cl.send(protocol.EncodeError(protocol.ErrorNoRecipient, err.Error()))
+					continue
+				}
+				if m.Type == protocol.MsgTypeFile {
+					restrictFileGrant(m.FileID, inboxes)
+				}
+			} else {
+				msgObj = room.publishChat(cl, msg)
+			}
+			if m.Type == protocol.MsgTypeFile {
+				if !attachStoredFile(room, m.FileID, msgObj) {
+					room.newFile(c, m.FileID, msgObj)
+				}
 			}
 		}
 	}()
 
-	// ticker := time.NewTicker(10 * time.Second)
-	// defer ticker.Stop()
-	// go func() {
-	// 	for {
-	// 		<-ticker.C
-	// 		if err := c.Ping(ctx); err != nil {
-	// 			log.Println(err.Error())
-	// 			close()
-	// 		}
-	// 	}
-	// }()
+	if *pingInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(*pingInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				pingCtx, cancel := context.WithTimeout(ctx, *pingTimeout)
+				err := c.Ping(pingCtx)
+				timeout := pingCtx.Err() == context.DeadlineExceeded
+				cancel()
+				if err != nil {
+					if timeout {
+						log.Printf("Reaped %s (%s) in room %q: no pong within %s", cl.session().Name, r.RemoteAddr, room.name, *pingTimeout)
+					}
+					close()
+					return
+				}
+			}
+		}()
+	}
 
 	<-ctx.Done()
 }
 
-func dateNow() (now [8]byte) {
-	t := time.Now().UnixMilli()
-	for i := 7; i >= 0; i-- {
-		now[i] = byte(t & 0xFF)
-		t >>= 8
+// trackWebsocket counts a websocket handler in until it calls
+// websocketHandlers.Done, it returns false once the websockets are closing.
+func trackWebsocket() bool {
+	websocketsMu.Lock()
+	defer websocketsMu.Unlock()
+	select {
+	case <-websocketsClosing:
+		return false
+	default:
 	}
-	return
+	websocketHandlers.Add(1)
+	return true
 }
 
-func uint32ToBytes(num uint32) (result [4]byte) {
-	for i := 3; i >= 0; i-- {
-		result[i] = byte(num & 0xFF)
-		num >>= 8
+// closeWebsockets closes every websocket and waits for their handlers to be
+// done with the rooms.
+func closeWebsockets(ctx context.Context) error {
+	websocketsMu.Lock()
+	close(websocketsClosing)
+	websocketsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		websocketHandlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dateNow returns the current unix millisecond, it never returns the same
+// value twice so it identifies a message.
+func dateNow() int64 {
+	lastNowMu.Lock()
+	defer lastNowMu.Unlock()
+	t := time.Now().UnixMilli()
+	if t <= lastNow {
+		t = lastNow + 1
 	}
-	return
+	lastNow = t
+	return t
 }
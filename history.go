@@ -0,0 +1,278 @@
+package main
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/binary"
+	"log"
+	"math"
+
+	"github.com/jinliming2/LAN-Share/protocol"
+)
+
+// serverEpoch identifies this server instance, so file ids from a previous
+// run are never taken for current ones.
+var serverEpoch = newEpoch()
+
+// newEpoch returns a random epoch, identifying a server or room instance.
+func newEpoch() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint32(b[:])
+}
+
+type historyEntry struct {
+	// id in the history store of its room, 0 if the message is not persisted
+	id      uint64
+	data    []byte
+	removed bool
+	// the inboxes of a private message, nil for the public ones
+	inboxes []string
+	// inbox of the sender
+	author string
+	// sequence number of the latest edit, 0 if never edited
+	revision uint64
+}
+
+// loadHistory opens the history store in dir and fills history with the
+// persisted messages.
+func (r *room) loadHistory(dir string) error {
+	store, records, err := openHistoryStore(dir)
+	if err != nil {
+		return err
+	}
+	r.historyStorage = store
+
+	r.historyMu.Lock()
+	defer r.historyMu.Unlock()
+
+	for _, record := range records {
+		author, msg, err := decodeHistoryRecord(record.data)
+		if err == nil {
+			_, err = protocol.DecodeChat(msg)
+		}
+		if err != nil {
+			log.Printf("Dropped history record %d in %s: %v", record.id, dir, err)
+			if err := store.Remove(record.id); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		r.pushHistory(&historyEntry{id: record.id, data: msg, author: author})
+		if seq := protocol.ChatSeq(msg); seq > r.seq {
+			r.seq = seq
+		}
+	}
+	r.trimHistory()
+	if back := r.history.Back(); back != nil {
+		// keep timestamps unique after a restart
+		if t := protocol.ChatTime(back.Value.(*historyEntry).data); t > lastNow {
+			lastNow = t
+		}
+	}
+	log.Printf("Loaded %d messages (%d bytes) from %s", r.history.Len(), r.historyBytes, dir)
+	return nil
+}
+
+func (r *room) closeHistory() {
+	if r.historyStorage == nil {
+		return
+	}
+	if err := r.historyStorage.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+// recordHistory numbers msg sent from the author inbox and appends it to
+// history, writing it through to the store if it survives a restart, and
+// returns the entries evicted to make room for it.
+func (r *room) recordHistory(msg []byte, author string) (elem *list.Element, evicted []*historyEntry) {
+	r.historyMu.Lock()
+	defer r.historyMu.Unlock()
+
+	r.seq++
+	protocol.SetChatSeq(msg, r.seq)
+	entry := &historyEntry{data: msg, author: author}
+	if r.historyStorage != nil && persistable(msg) {
+		id, err := r.historyStorage.Append(encodeHistoryRecord(author, msg))
+		if err != nil {
+			log.Println(err)
+		} else {
+			entry.id = id
+		}
+	}
+
+	elem = r.pushHistory(entry)
+	evicted = r.trimHistory()
+	return
+}
+
+// historySince returns the sync notice and the messages for a client which
+// has seen the messages of epoch up to sequence number since, along with the
+// updates of the ones it has which were edited since. The client starts over
+// with the latest page if it is new, from another instance of the room, missed
+// evicted messages or more than a page of them.
+func (r *room) historySince(epoch uint32, since uint64, resume bool, page int) (notice []byte, missing [][]byte) {
+	r.historyMu.Lock()
+	defer r.historyMu.Unlock()
+
+	reset := !resume || epoch != r.epoch || since > r.seq || r.trimmedSeq > since
+	if !reset {
+		for elem := r.history.Back(); elem != nil && protocol.ChatSeq(elem.Value.(*historyEntry).data) > since; elem = elem.Prev() {
+			if len(missing) == page {
+				reset = true
+				break
+			}
+			missing = append(missing, elem.Value.(*historyEntry).data)
+		}
+		reverse(missing)
+	}
+
+	sync := &protocol.Sync{Reset: reset, Epoch: r.epoch}
+	if reset {
+		return protocol.EncodeSync(sync), r.historyBefore(math.MaxUint64, page)
+	}
+	for elem := r.history.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*historyEntry)
+		if seq := protocol.ChatSeq(entry.data); seq <= since {
+			// still retained, the client drops the ones not listed
+			sync.Retained = append(sync.Retained, seq)
+			if entry.revision > since {
+				missing = append(missing, protocol.EncodeUpdate(entry.revision, entry.data))
+			}
+		}
+	}
+	return protocol.EncodeSync(sync), missing
+}
+
+// historyPage returns at most limit messages older than sequence number
+// before, oldest first.
+func (r *room) historyPage(before uint64, limit int) [][]byte {
+	r.historyMu.Lock()
+	defer r.historyMu.Unlock()
+	return r.historyBefore(before, limit)
+}
+
+func (r *room) historyBefore(before uint64, limit int) (page [][]byte) {
+	for elem := r.history.Back(); elem != nil && len(page) < limit; elem = elem.Prev() {
+		if data := elem.Value.(*historyEntry).data; protocol.ChatSeq(data) < before {
+			page = append(page, data)
+		}
+	}
+	reverse(page)
+	return
+}
+
+// forgetHistory drops elem from history, it is a no-op if elem is already
+// evicted.
+func (r *room) forgetHistory(elem *list.Element) {
+	r.historyMu.Lock()
+	defer r.historyMu.Unlock()
+	r.removeHistory(elem)
+}
+
+func (r *room) pushHistory(entry *historyEntry) *list.Element {
+	r.historyBytes += len(entry.data)
+	r.historyTypeBytes[protocol.ChatType(entry.data)] += len(entry.data)
+	return r.history.PushBack(entry)
+}
+
+func (r *room) removeHistory(elem *list.Element) *historyEntry {
+	entry := elem.Value.(*historyEntry)
+	if entry.removed {
+		return entry
+	}
+	entry.removed = true
+	if entry.inboxes != nil {
+		r.private.Remove(elem)
+		for _, inbox := range entry.inboxes {
+			r.dropInbox(inbox, len(entry.data))
+		}
+		return entry
+	}
+	r.history.Remove(elem)
+	r.historyBytes -= len(entry.data)
+	r.historyTypeBytes[protocol.ChatType(entry.data)] -= len(entry.data)
+
+	if entry.id != 0 && r.historyStorage != nil {
+		if err := r.historyStorage.Remove(entry.id); err != nil {
+			log.Println(err)
+		}
+	}
+	return entry
+}
+
+// trimHistory evicts the oldest messages until history fits in the count
+// limit, the total byte budget and every per type byte budget.
+func (r *room) trimHistory() (evicted []*historyEntry) {
+	defer func() {
+		for _, entry := range evicted {
+			if seq := protocol.ChatSeq(entry.data); seq > r.trimmedSeq {
+				r.trimmedSeq = seq
+			}
+		}
+	}()
+	for r.history.Len() > 0 && (r.maxHistory > 0 && r.history.Len() > r.maxHistory || r.maxHistoryBytes > 0 && r.historyBytes > r.maxHistoryBytes) {
+		evicted = append(evicted, r.removeHistory(r.history.Front()))
+	}
+	for mt, budget := range historyTypeBudget {
+		if *budget <= 0 {
+			continue
+		}
+		elem := r.history.Front()
+		for elem != nil && r.historyTypeBytes[mt] > *budget {
+			next := elem.Next()
+			if protocol.ChatType(elem.Value.(*historyEntry).data) == mt {
+				evicted = append(evicted, r.removeHistory(elem))
+			}
+			elem = next
+		}
+	}
+	return
+}
+
+// persistable reports whether msg is worth persisting, files are gone along
+// with their sender so they are never written to disk.
+func persistable(msg []byte) bool {
+	switch protocol.ChatType(msg) {
+	case protocol.MsgTypeText, protocol.MsgTypeRichText, protocol.MsgTypeImage, protocol.MsgTypeDeleted:
+		return true
+	}
+	return false
+}
+
+// encodeHistoryRecord builds the store record of msg sent from the author
+// inbox, [2 byte length][author][msg].
+func encodeHistoryRecord(author string, msg []byte) []byte {
+	record := make([]byte, 0, 2+len(author)+len(msg))
+	record = binary.BigEndian.AppendUint16(record, uint16(len(author)))
+	record = append(record, author...)
+	return append(record, msg...)
+}
+
+// decodeHistoryRecord returns the author inbox and the message of a store
+// record.
+func decodeHistoryRecord(record []byte) (author string, msg []byte, err error) {
+	if len(record) < 2 || len(record) < 2+int(binary.BigEndian.Uint16(record)) {
+		return "", nil, errCorruptedRecord
+	}
+	end := 2 + int(binary.BigEndian.Uint16(record))
+	return string(record[2:end]), record[end:], nil
+}
+
+func reverse(msgs [][]byte) {
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+}
+
+// evictMessage builds the notice telling clients to drop evicted messages.
+func evictMessage(evicted []*historyEntry) []byte {
+	times := make([]int64, len(evicted))
+	for i, entry := range evicted {
+		times[i] = protocol.ChatTime(entry.data)
+	}
+	return protocol.EncodeEvict(times...)
+}
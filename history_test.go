@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jinliming2/LAN-Share/protocol"
+)
+
+// chatFrame returns a chat frame of type mt sent at time, of the same size
+// for every time.
+func chatFrame(t *testing.T, mt protocol.MsgType, time int64) []byte {
+	t.Helper()
+	m := protocol.Message{Type: mt, Text: strings.Repeat("t", 100)}
+	if mt == protocol.MsgTypeImage {
+		m = protocol.Message{Type: mt, MIME: "image/png", Data: bytes.Repeat([]byte{1}, 300)}
+	}
+	frame, err := protocol.EncodeChat(&protocol.Chat{Message: m, Time: time})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// setTypeBudgets sets the per type byte budgets until the test ends.
+func setTypeBudgets(t *testing.T, budgets map[protocol.MsgType]int) {
+	for mt, budget := range historyTypeBudget {
+		old := *budget
+		t.Cleanup(func() { *budget = old })
+		*budget = budgets[mt]
+	}
+}
+
+func TestTrimHistory(t *testing.T) {
+	const (
+		T = protocol.MsgTypeText
+		I = protocol.MsgTypeImage
+	)
+	text := len(chatFrame(t, T, 1))
+	image := len(chatFrame(t, I, 1))
+	tests := []struct {
+		name     string
+		count    int
+		bytes    int
+		budgets  map[protocol.MsgType]int
+		messages []protocol.MsgType
+		// times of the messages evicted, which are sent at 1, 2, 3...
+		evicted []int64
+	}{
+		{"no limit", 0, 0, nil, []protocol.MsgType{T, T, I, T}, nil},
+		{"count", 3, 0, nil, []protocol.MsgType{T, I, T, T, T}, []int64{1, 2}},
+		{"bytes", 0, 2*text + text/2, nil, []protocol.MsgType{T, T, T, T}, []int64{1, 2}},
+		{"bytes of mixed types", 0, image + text, nil, []protocol.MsgType{I, T, I, T}, []int64{1, 2}},
+		{"message over the byte budget", 0, text - 1, nil, []protocol.MsgType{T, T}, []int64{1, 2}},
+		{"text budget", 0, 0, map[protocol.MsgType]int{T: 2 * text}, []protocol.MsgType{T, I, T, I, T, T}, []int64{1, 3}},
+		{"image budget", 0, 0, map[protocol.MsgType]int{I: image}, []protocol.MsgType{I, T, I, T, I}, []int64{1, 3}},
+		{"count and budget", 2, 0, map[protocol.MsgType]int{I: image}, []protocol.MsgType{I, I, T, T}, []int64{1, 2}},
+		{"every limit", 0, image + text, map[protocol.MsgType]int{T: text, I: image}, []protocol.MsgType{T, I, I, T, T}, []int64{1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		setTypeBudgets(t, tt.budgets)
+		r := newRoom("")
+		r.maxHistory, r.maxHistoryBytes = tt.count, tt.bytes
+
+		var evicted []int64
+		for i, mt := range tt.messages {
+			_, entries := r.recordHistory(chatFrame(t, mt, int64(i+1)), "")
+			if len(entries) == 0 {
+				continue
+			}
+			notice := evictMessage(entries)
+			var times []int64
+			for _, entry := range entries {
+				times = append(times, protocol.ChatTime(entry.data))
+			}
+			if !bytes.Equal(notice, protocol.EncodeEvict(times...)) {
+				t.Errorf("%s: notice %x for %v", tt.name, notice, times)
+			}
+			evicted = append(evicted, times...)
+		}
+		if !reflect.DeepEqual(evicted, tt.evicted) {
+			t.Errorf("%s: evicted %v, want %v", tt.name, evicted, tt.evicted)
+		}
+
+		// the rest is kept in order, within every limit
+		var kept []int64
+		size := 0
+		typeBytes := make(map[protocol.MsgType]int)
+		for elem := r.history.Front(); elem != nil; elem = elem.Next() {
+			data := elem.Value.(*historyEntry).data
+			kept = append(kept, protocol.ChatTime(data))
+			size += len(data)
+			typeBytes[protocol.ChatType(data)] += len(data)
+		}
+		if len(kept)+len(evicted) != len(tt.messages) {
+			t.Errorf("%s: kept %v along with evicted %v", tt.name, kept, evicted)
+		}
+		for i := 1; i < len(kept); i++ {
+			if kept[i-1] >= kept[i] {
+				t.Errorf("%s: kept %v out of order", tt.name, kept)
+			}
+		}
+		if size != r.historyBytes || !reflect.DeepEqual(typeBytes, nonZero(r.historyTypeBytes)) {
+			t.Errorf("%s: accounted %d bytes %v, history has %d %v", tt.name, r.historyBytes, r.historyTypeBytes, size, typeBytes)
+		}
+
+		// a client which missed evicted messages starts over
+		if len(evicted) > 0 {
+			if r.trimmedSeq == 0 {
+				t.Errorf("%s: evicted sequence numbers not recorded", tt.name)
+			}
+			notice, _ := r.historySince(r.epoch, r.trimmedSeq-1, true, historyPageSize)
+			if notice[1] != 1 {
+				t.Errorf("%s: client missing evicted messages not reset", tt.name)
+			}
+		}
+	}
+}
+
+func nonZero(m map[protocol.MsgType]int) map[protocol.MsgType]int {
+	nz := make(map[protocol.MsgType]int)
+	for k, v := range m {
+		if v != 0 {
+			nz[k] = v
+		}
+	}
+	return nz
+}
+
+func TestPublishChatEvictNotice(t *testing.T) {
+	setTypeBudgets(t, nil)
+	r := newRoom("")
+	r.maxHistory, r.maxHistoryBytes = 1, 0
+	sub := &client{queue: make(chan []byte, 8)}
+	r.subscribers[nil] = sub
+
+	first := chatFrame(t, protocol.MsgTypeText, 1)
+	second := chatFrame(t, protocol.MsgTypeText, 2)
+	r.publishChat(sub, first)
+	r.publishChat(sub, second)
+
+	want := [][]byte{first, second, protocol.EncodeEvict(1)}
+	for i, w := range want {
+		select {
+		case got := <-sub.queue:
+			if !bytes.Equal(got, w) {
+				t.Errorf("frame %d: got %x, want %x", i, got, w)
+			}
+		default:
+			t.Fatalf("frame %d not sent", i)
+		}
+	}
+	select {
+	case got := <-sub.queue:
+		t.Errorf("extra frame %x", got)
+	default:
+	}
+}
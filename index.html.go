@@ -12,7 +12,60 @@ const WebPageTemplate = `<!DOCTYPE html>
 	}
 	body {
 		display: grid;
-		grid-template: 1fr 64px / 1fr;
+		grid-template: 32px 1fr 64px / 1fr 200px;
+	}
+	#rooms, #form {
+		grid-column: 1 / -1;
+	}
+	#rooms {
+		display: flex;
+		align-items: center;
+		gap: 8px;
+		padding: 0 8px;
+		border-bottom: 1px solid #ccc;
+	}
+	#room-select {
+		height: 24px;
+		border: 1px solid #ccc;
+		background-color: transparent;
+	}
+	#rename {
+		width: auto;
+		height: 24px;
+		margin-left: auto;
+		padding: 0 8px;
+	}
+	#roster {
+		overflow-y: auto;
+		padding: 8px;
+		border-left: 1px solid #ccc;
+		font-size: 14px;
+	}
+	#roster h2 {
+		margin: 0 0 8px;
+		font-size: 1em;
+	}
+	#roster ul {
+		margin: 0;
+		padding: 0;
+		list-style: none;
+	}
+	#roster li {
+		margin-bottom: 8px;
+		overflow-wrap: anywhere;
+	}
+	#roster small {
+		display: block;
+		color: #888;
+	}
+	#roster input {
+		margin: 0 4px 0 0;
+	}
+	#private, #reply {
+		color: #36c;
+	}
+	#reply {
+		cursor: pointer;
 	}
 	#history {
 		display: flex;
@@ -71,6 +124,9 @@ const WebPageTemplate = `<!DOCTYPE html>
 		font-size: 12px;
 		color: #888;
 	}
+	#error {
+		color: #c00;
+	}
 	#connecting {
 		position: fixed;
 		left: 0;
@@ -86,7 +142,16 @@ const WebPageTemplate = `<!DOCTYPE html>
 </style>
 </head>
 <body>
+<nav id="rooms">
+	<label for="room-select">Room</label>
+	<select id="room-select"></select>
+	<button id="rename" type="button">Rename</button>
+</nav>
 <div id="history"></div>
+<aside id="roster">
+	<h2>Online</h2>
+	<ul id="roster-list"></ul>
+</aside>
 <template id="message">
 <style>
 	:host {
@@ -106,6 +171,14 @@ const WebPageTemplate = `<!DOCTYPE html>
 		font-style: italic;
 		line-height: 30px;
 	}
+	::slotted([slot=to]) {
+		margin-left: 8px;
+		line-height: 30px;
+		color: #555;
+	}
+	:host(.private) {
+		background-color: #cde;
+	}
 	header {
 		display: flex;
 		user-select: none;
@@ -117,11 +190,55 @@ const WebPageTemplate = `<!DOCTYPE html>
 		width: 100%;
 		text-align: center;
 	}
+	main {
+		white-space: pre-wrap;
+		overflow-wrap: anywhere;
+	}
+	main.rich {
+		white-space: normal;
+	}
+	main.deleted {
+		font-style: italic;
+		color: #666;
+	}
+	nav {
+		margin-left: auto;
+		visibility: hidden;
+	}
+	:host(:hover) nav {
+		visibility: visible;
+	}
+	nav button {
+		border: none;
+		background: none;
+		color: #36c;
+		cursor: pointer;
+	}
+	:host(:not([data-editable])) [data-action=edit] {
+		display: none;
+	}
+	blockquote {
+		margin: 0 0 8px;
+		padding-left: 8px;
+		border-left: 3px solid #888;
+		color: #555;
+		cursor: pointer;
+		overflow: hidden;
+		white-space: nowrap;
+		text-overflow: ellipsis;
+	}
 </style>
 <header>
 	<slot name="name"></slot>
 	<slot name="time"></slot>
+	<slot name="to"></slot>
+	<nav>
+		<button type="button" data-action="reply">Reply</button>
+		<button type="button" data-action="edit">Edit</button>
+		<button type="button" data-action="delete">Delete</button>
+	</nav>
 </header>
+<blockquote hidden></blockquote>
 <main></main>
 </template>
 <form id="form">
@@ -134,7 +251,13 @@ const WebPageTemplate = `<!DOCTYPE html>
 		</div>
 	</div>
 	<input id="file-selector" type="file">
-	<div id="tip">Press Shift+Enter to send</div>
+	<div id="tip">
+		<label title="Allows basic formatting tags such as &lt;b&gt;, &lt;a&gt; and &lt;ul&gt;"><input name="rich" type="checkbox"> Rich text</label>
+		Press Shift+Enter to send
+		<span id="private"></span>
+		<span id="reply" title="Click to cancel"></span>
+		<span id="error"></span>
+	</div>
 </form>
 <div id="connecting"><span>Connecting......</span></div>
 <script>
@@ -146,6 +269,17 @@ const image = document.getElementById('image');
 const file = document.getElementById('file');
 const connecting = document.getElementById('connecting');
 const fileSelector = document.getElementById('file-selector');
+const errorTip = document.getElementById('error');
+const rename = document.getElementById('rename');
+const rosterList = document.getElementById('roster-list');
+// the sessions in the room by id
+const roster = new Map();
+// the sessions the messages are sent to privately, everyone if empty
+const recipients = new Set();
+const privateTip = document.getElementById('private');
+// the timestamp of the message replied to by the next one sent, if any
+let replyTo = 0;
+const replyTip = document.getElementById('reply');
 const fileHolder = {};
 const MsgType = {
 	Text: 0,
@@ -153,137 +287,539 @@ const MsgType = {
 	File: 2,
 	ClearFile: 3,
 	RequestFile: 4,
+	Evict: 5,
+	RichText: 6,
+	Sync: 7,
+	Error: 8,
+	Hello: 9,
+	Presence: 10,
+	Rename: 11,
+	Direct: 12,
+	Delete: 13,
+	Edit: 14,
+	Reply: 15,
+	Deleted: 16,
+	Update: 17,
 };
+// the protocol version spoken by this page
+const protocolVersion = 4;
+const roomSelect = document.getElementById('room-select');
 const query = new URLSearchParams(location.search);
-const wsURL = new URL(` + "`" + `/ws${query.get('name') ? ` + "`" + `?name=${query.get('name')}` + "`" + ` : ''}` + "`" + `, location.href);
-wsURL.protocol = wsURL.protocol === 'https' ? 'wss' : 'ws';
+const room = query.get('room') || '';
+// shared by the devices of one person, which get each other's private messages
+if (query.get('owner')) {
+	localStorage.setItem('lan-share-owner', query.get('owner'));
+	query.delete('owner');
+	window.history.replaceState(null, '', ` + "`" + `?${query.toString()}` + "`" + `);
+}
+if (!localStorage.getItem('lan-share-owner')) {
+	localStorage.setItem('lan-share-owner', [...crypto.getRandomValues(new Uint8Array(16))].map(b => b.toString(16).padStart(2, '0')).join(''));
+}
+const owner = localStorage.getItem('lan-share-owner');
+const roomPasswordKey = name => ` + "`" + `lan-share-room-password:${name}` + "`" + `;
+const switchRoom = (name, password) => {
+	if (password) {
+		sessionStorage.setItem(roomPasswordKey(name), password);
+	}
+	const search = new URLSearchParams(location.search);
+	if (name) {
+		search.set('room', name);
+	} else {
+		search.delete('room');
+	}
+	location.search = search.toString();
+};
+const loadRooms = async () => {
+	const rooms = await fetch('/rooms').then(res => res.json()).catch(() => []);
+	if (!rooms.some(r => r.name === room)) {
+		rooms.push({ name: room, protected: false, online: 0 });
+	}
+	roomSelect.innerHTML = '';
+	for (const r of rooms) {
+		const option = document.createElement('option');
+		option.value = r.name;
+		option.textContent = ` + "`" + `${r.name || 'Lobby'}${r.protected ? ' (locked)' : ''} - ${r.online} online` + "`" + `;
+		option.dataset.protected = r.protected;
+		option.selected = r.name === room;
+		roomSelect.appendChild(option);
+	}
+	const create = document.createElement('option');
+	create.dataset.create = 'true';
+	create.textContent = 'New room...';
+	roomSelect.appendChild(create);
+};
+roomSelect.addEventListener('change', () => {
+	const option = roomSelect.selectedOptions[0];
+	if (option.dataset.create) {
+		const name = prompt('Room name')?.trim();
+		if (!name) {
+			roomSelect.value = room;
+			return;
+		}
+		switchRoom(name, prompt('Room password, leave empty for a public room') || '');
+		return;
+	}
+	if (option.dataset.protected === 'true' && !sessionStorage.getItem(roomPasswordKey(option.value))) {
+		const password = prompt(` + "`" + `Password of ${option.textContent}` + "`" + `);
+		if (password === null) {
+			roomSelect.value = room;
+			return;
+		}
+		switchRoom(option.value, password);
+		return;
+	}
+	switchRoom(option.value);
+});
+roomSelect.addEventListener('focus', loadRooms);
+const wsURL = new URL('/ws', location.href);
+wsURL.protocol = wsURL.protocol === 'https:' ? 'wss:' : 'ws:';
 let ws;
-const connect = () => {
-	ws = new WebSocket(wsURL.toString());
-	ws.addEventListener('open', () => {
-		history.innerHTML = '';
-		connecting.style.display = 'none';
-		textarea.focus();
-	});
-	ws.addEventListener('close', () => {
-		ws = undefined;
-		connecting.style.display = '';
-		textarea.blur();
-		setTimeout(connect, 1e3);
+// what has been received, so a reconnect only fetches the messages missed
+let epoch;
+// what the server supports, from its hello
+let server;
+let lastSeq = 0;
+const renderRoster = () => {
+	const items = [...roster.values()].sort((a, b) => a.since - b.since).map(s => {
+		const li = document.createElement('li');
+		li.textContent = s.id === server?.session ? ` + "`" + `${s.name} (you)` + "`" + ` : s.name;
+		const detail = document.createElement('small');
+		detail.textContent = ` + "`" + `${s.device} · ${s.addr}` + "`" + `;
+		detail.title = ` + "`" + `Online since ${new Date(s.since).toLocaleString()}` + "`" + `;
+		li.appendChild(detail);
+		if (s.id === server?.session) {
+			// opened on another device, it shares the private messages of this one
+			const link = document.createElement('a');
+			const params = new URLSearchParams(query);
+			params.set('owner', owner);
+			link.href = ` + "`" + `?${params.toString()}` + "`" + `;
+			link.textContent = 'Link another device';
+			link.title = 'Open this link on your other device';
+			li.appendChild(link);
+			return li;
+		}
+		const to = document.createElement('input');
+		to.type = 'checkbox';
+		to.title = 'Send privately';
+		to.checked = recipients.has(s.id);
+		to.addEventListener('change', () => {
+			if (to.checked) {
+				recipients.add(s.id);
+			} else {
+				recipients.delete(s.id);
+			}
+			renderRoster();
+		});
+		li.prepend(to);
+		return li;
 	});
-	ws.addEventListener('message', async ({ data }) => {
-		const arrayBuffer = await data.arrayBuffer();
-		const view = new DataView(arrayBuffer);
-		let offset = 0;
-		const type = view.getUint8(offset++);
-		if (type === MsgType.RequestFile) {
+	rosterList.replaceChildren(...items);
+	for (const id of recipients) {
+		if (!roster.has(id)) {
+			recipients.delete(id);
+		}
+	}
+	const names = [...recipients].map(id => roster.get(id).name);
+	privateTip.textContent = names.length ? ` + "`" + `Private to ${names.join(', ')}` + "`" + ` : '';
+};
+// sessionNames names the sessions of the roster, the ones gone as someone
+const sessionNames = ids => ids.map(id => id === server?.session ? 'you' : roster.get(id)?.name || 'someone').join(', ');
+// direct wraps a message for the recipients, if any
+const direct = parts => {
+	const to = [...recipients].map(id => encoder.encode(id));
+	if (!to.length) {
+		return new Blob(parts);
+	}
+	return new Blob([Uint8Array.from([MsgType.Direct, to.length]), ...to.flatMap(id => [Uint8Array.from([id.length]), id]), ...parts]);
+};
+const uint64 = n => {
+	const bytes = new Uint8Array(8);
+	new DataView(bytes.buffer).setBigUint64(0, BigInt(n));
+	return bytes;
+};
+const readUint64 = (view, offset) => {
+	let n = 0;
+	for (let i = 56; i >= 0; i -= 8) {
+		n += view.getUint8(offset++) * (2 ** i);
+	}
+	return n;
+};
+let scrollTimeout = 0;
+// older messages are fetched page by page as the history is scrolled up
+let loadingOlder = false;
+let noOlder = false;
+// an update replaces the message of the same timestamp, if it is shown
+const handleFrame = (arrayBuffer, older = false, direct = null, update = false) => {
+	const view = new DataView(arrayBuffer);
+	let offset = 0;
+	const type = view.getUint8(offset++);
+	if (type === MsgType.Update) {
+		lastSeq = Math.max(lastSeq, readUint64(view, offset));
+		handleFrame(arrayBuffer.slice(offset + 8), true, null, true);
+		return;
+	}
+	if (type === MsgType.Direct) {
+		const fromLen = view.getUint8(offset++);
+		const from = decoder.decode(arrayBuffer.slice(offset, offset + fromLen));
+		offset += fromLen;
+		const to = [];
+		for (let count = view.getUint8(offset++); count > 0; --count) {
+			const len = view.getUint8(offset++);
+			to.push(decoder.decode(arrayBuffer.slice(offset, offset + len)));
+			offset += len;
+		}
+		handleFrame(arrayBuffer.slice(offset), older, { from, to }, update);
+		return;
+	}
+	if (type === MsgType.RequestFile) {
+		let id = 0;
+		for (let i = 24; i >= 0; i -= 8) {
+			id += view.getUint8(offset++) * (2 ** i);
+		}
+		const { file, secret, epoch: fileEpoch } = fileHolder[id] || {};
+		// an id issued by a previous server instance is another file now
+		if (file && fileEpoch === server?.epoch) {
+			const query = new URLSearchParams({ epoch: fileEpoch, secret });
+			// the server asks for a single range covering what is downloaded
+			let body = file;
+			if (offset < view.byteLength) {
+				const range = decoder.decode(arrayBuffer.slice(offset));
+				const match = range.match(/^bytes=(\d+)-(\d+)$/);
+				if (match) {
+					query.set('range', range);
+					body = file.slice(Number(match[1]), Number(match[2]) + 1);
+				}
+			}
+			fetch(` + "`" + `/upload/${id}?${query.toString()}` + "`" + `, {
+				method: 'POST',
+				headers: { 'Content-Type': file.type },
+				body,
+			}).catch(console.error);
+		}
+		return;
+	}
+	if (type === MsgType.ClearFile) {
+		while (offset < view.byteLength) {
 			let id = 0;
 			for (let i = 24; i >= 0; i -= 8) {
 				id += view.getUint8(offset++) * (2 ** i);
 			}
-			const file = fileHolder[id]?.file;
-			if (file) {
-				let range;
-				let contentRange;
-				let fileRange;
-				if (offset < view.byteLength) {
-					range = decoder.decode(arrayBuffer.slice(offset));
-					const match = range.split(',')[0].match(/^(?<unit>[^=]+)=(?<start>\d*)-(?<end>\d*)/);
-					if (match) {
-						if (match.groups.start) {
-							fileRange = [Number(match.groups.start), match.groups.end ? Number(match.groups.end) + 1 : file.size];
-							contentRange = ` + "`" + `${match.groups.unit} ${fileRange[0]}-${fileRange[1] - 1}/${file.size}` + "`" + `;
-						} else if (match.groups.end) {
-							fileRange = [file.size - Number(match.groups.end), file.size];
-							contentRange = ` + "`" + `${match.groups.unit} ${fileRange[0]}-${fileRange[1] - 1}/${file.size}` + "`" + `;
-						}
-					}
-				}
-				const query = new URLSearchParams({
-					name: file.name,
-					size: fileRange ? fileRange[1] - fileRange[0] : file.size,
-					type: file.type,
-				});
-				if (range) {
-					query.set('range', range);
-				}
-				fetch(` + "`" + `/upload/${id}?${query.toString()}` + "`" + `, {
-					method: 'POST',
-					headers: {
-						'Content-Type': file.type,
-						...(contentRange ? { 'Content-Range': contentRange } : {}),
-					},
-					body: fileRange ? file.slice(fileRange[0], fileRange[1]) : file,
-				}).catch(console.error);
+			const ele = history.querySelector(` + "`" + `[data-file="${id}"]` + "`" + `);
+			ele?.remove();
+		}
+		return;
+	}
+	if (type === MsgType.Hello) {
+		server = JSON.parse(decoder.decode(arrayBuffer.slice(offset)));
+		for (const id of Object.keys(fileHolder)) {
+			if (fileHolder[id].epoch !== server.epoch) {
+				delete fileHolder[id];
 			}
-			return;
 		}
-		if (type === MsgType.ClearFile) {
-			while (offset < view.byteLength) {
-				let id = 0;
-				for (let i = 24; i >= 0; i -= 8) {
-					id += view.getUint8(offset++) * (2 ** i);
-				}
-				const ele = history.querySelector(` + "`" + `[data-file="${id}"]` + "`" + `);
-				ele?.remove();
+		return;
+	}
+	if (type === MsgType.Presence) {
+		const { event, sessions } = JSON.parse(decoder.decode(arrayBuffer.slice(offset)));
+		if (event === 'snapshot') {
+			roster.clear();
+		}
+		for (const s of sessions) {
+			if (event === 'leave') {
+				roster.delete(s.id);
+				continue;
 			}
+			roster.set(s.id, s);
+			if (event === 'rename' && s.id === server?.session) {
+				// keep the name across reconnects and reloads
+				query.set('name', s.name);
+				window.history.replaceState(null, '', ` + "`" + `?${query.toString()}` + "`" + `);
+			}
+		}
+		renderRoster();
+		return;
+	}
+	if (type === MsgType.Error) {
+		// the server rejected a message sent from here
+		const code = view.getUint8(offset++);
+		const message = decoder.decode(arrayBuffer.slice(offset));
+		console.warn(` + "`" + `Message rejected (${code}): ${message}` + "`" + `);
+		errorTip.textContent = ` + "`" + `Not sent: ${message}` + "`" + `;
+		clearTimeout(errorTip.timeout);
+		errorTip.timeout = setTimeout(() => errorTip.textContent = '', 5e3);
+		return;
+	}
+	if (type === MsgType.Sync) {
+		const reset = view.getUint8(offset++);
+		epoch = view.getUint32(offset);
+		offset += 4;
+		if (reset) {
+			history.innerHTML = '';
+			lastSeq = 0;
+			noOlder = false;
 			return;
 		}
-		const nameLen = view.getUint8(offset++);
-		const name = document.createElement('div');
-		name.slot = 'name';
-		name.innerHTML = decoder.decode(arrayBuffer.slice(offset, offset + nameLen));
-		offset += nameLen;
-		let scrollTimeout = 0;
-		let timestamp = 0;
-		for (let i = 56; i >= 0; i -= 8) {
-			timestamp += view.getUint8(offset++) * (2 ** i);
+		const retained = new Set();
+		for (; offset < view.byteLength; offset += 8) {
+			retained.add(String(readUint64(view, offset)));
 		}
-		const time = document.createElement('time');
-		time.slot = 'time';
-		const date = new Date(timestamp);
-		time.dateTime = date.toJSON();
-		time.innerHTML = date.toLocaleString();
-		const msg = document.createElement('lan-share-msg');
-		msg.dataset.time = timestamp;
-		msg.appendChild(name);
-		msg.appendChild(time);
-		switch (type) {
-		case MsgType.Text:
-			msg.setText(decoder.decode(arrayBuffer.slice(offset)));
-			break;
-		case MsgType.Image:
-			const imageTypeLen = view.getUint8(offset++);
-			const imageType = decoder.decode(arrayBuffer.slice(offset, offset + imageTypeLen));
-			offset += imageTypeLen;
-			msg.setImage(imageType, arrayBuffer.slice(offset));
-			break;
-		case MsgType.File:
-			let id = 0;
-			for (let i = 24; i >= 0; i -= 8) {
-				id += view.getUint8(offset++) * (2 ** i);
+		for (const ele of [...history.children]) {
+			if (!retained.has(ele.dataset.seq)) {
+				ele.remove();
 			}
-			msg.dataset.file = id;
-			const info = JSON.parse(decoder.decode(arrayBuffer.slice(offset)));
-			msg.setFile(id, info);
+		}
+		return;
+	}
+	if (type === MsgType.Evict) {
+		while (offset < view.byteLength) {
+			let timestamp = 0;
+			for (let i = 56; i >= 0; i -= 8) {
+				timestamp += view.getUint8(offset++) * (2 ** i);
+			}
+			const ele = history.querySelector(` + "`" + `[data-time="${timestamp}"]` + "`" + `);
+			ele?.remove();
+		}
+		return;
+	}
+	const seq = readUint64(view, offset);
+	offset += 8;
+	// published while the history was being sent, private messages are only
+	// numbered by their timestamp
+	if (!direct && !update && history.querySelector(` + "`" + `[data-seq="${seq}"]` + "`" + `)) {
+		return;
+	}
+	if (!direct) {
+		lastSeq = Math.max(lastSeq, seq);
+	}
+	const nameLen = view.getUint8(offset++);
+	const name = document.createElement('div');
+	name.slot = 'name';
+	name.textContent = decoder.decode(arrayBuffer.slice(offset, offset + nameLen));
+	offset += nameLen;
+	let timestamp = 0;
+	for (let i = 56; i >= 0; i -= 8) {
+		timestamp += view.getUint8(offset++) * (2 ** i);
+	}
+	const existing = history.querySelector(` + "`" + `[data-time="${timestamp}"]` + "`" + `);
+	if (update ? !existing : direct && existing) {
+		return;
+	}
+	const time = document.createElement('time');
+	time.slot = 'time';
+	const date = new Date(timestamp);
+	time.dateTime = date.toJSON();
+	time.textContent = date.toLocaleString();
+	const msg = document.createElement('lan-share-msg');
+	msg.dataset.time = timestamp;
+	msg.appendChild(name);
+	msg.appendChild(time);
+	if (direct) {
+		const to = document.createElement('span');
+		to.slot = 'to';
+		to.textContent = ` + "`" + `privately to ${sessionNames(direct.to)}` + "`" + `;
+		msg.appendChild(to);
+		msg.classList.add('private');
+	} else {
+		msg.dataset.seq = seq;
+	}
+	let msgType = type;
+	if (type === MsgType.Reply) {
+		const replied = readUint64(view, offset);
+		offset += 8;
+		msgType = view.getUint8(offset++);
+		const original = history.querySelector(` + "`" + `[data-time="${replied}"]` + "`" + `);
+		msg.setReply(replied, original ? ` + "`" + `${original.querySelector('[slot=name]').textContent}: ${original.preview}` + "`" + ` : 'an earlier message');
+	}
+	switch (msgType) {
+	case MsgType.Deleted:
+		msg.setDeleted();
+		break;
+	case MsgType.Text:
+		msg.setText(decoder.decode(arrayBuffer.slice(offset)));
+		break;
+	case MsgType.RichText:
+		msg.setRichText(decoder.decode(arrayBuffer.slice(offset)));
+		break;
+	case MsgType.Image:
+		const imageTypeLen = view.getUint8(offset++);
+		const imageType = decoder.decode(arrayBuffer.slice(offset, offset + imageTypeLen));
+		offset += imageTypeLen;
+		msg.setImage(imageType, arrayBuffer.slice(offset));
+		break;
+	case MsgType.File:
+		let id = 0;
+		for (let i = 24; i >= 0; i -= 8) {
+			id += view.getUint8(offset++) * (2 ** i);
+		}
+		msg.dataset.file = id;
+		const info = JSON.parse(decoder.decode(arrayBuffer.slice(offset)));
+		msg.setFile(info, direct ? owner : '');
+		break;
+	}
+	if (update) {
+		existing.replaceWith(msg);
+		return;
+	}
+	const children = history.children;
+	let target = children[0] || null;
+	for (let i = children.length - 1; i >= 0; --i) {
+		if (Number(children[i].dataset.time) < timestamp) {
+			target = children[i + 1] || null;
 			break;
 		}
-		const children = history.children;
-		let target = children[0] || null;
-		for (let i = children.length - 1; i >= 0; --i) {
-			if (Number(children[i].dataset.time) < timestamp) {
-				target = children[i + 1] || null;
-				break;
+	}
+	history.insertBefore(msg, target);
+	if (older) {
+		return;
+	}
+	if (scrollTimeout) {
+		clearTimeout(scrollTimeout);
+	}
+	scrollTimeout = setTimeout(() => {
+		msg.scrollIntoView({ behavior: 'smooth', block: 'nearest' });
+	}, 0.1e3);
+};
+const loadOlder = async () => {
+	if (loadingOlder || noOlder || !history.querySelector('[data-seq]')) {
+		return;
+	}
+	loadingOlder = true;
+	const params = new URLSearchParams({
+		before: Math.min(...[...history.querySelectorAll('[data-seq]')].map(ele => Number(ele.dataset.seq))),
+	});
+	if (room) {
+		params.set('room', room);
+	}
+	const password = sessionStorage.getItem(roomPasswordKey(room));
+	if (password) {
+		params.set('password', password);
+	}
+	try {
+		const res = await fetch(` + "`" + `/api/history?${params.toString()}` + "`" + `);
+		if (!res.ok) {
+			return;
+		}
+		const buffer = await res.arrayBuffer();
+		const view = new DataView(buffer);
+		// keep the visible messages in place while prepending
+		const height = history.scrollHeight;
+		let offset = 0;
+		while (offset + 4 <= buffer.byteLength) {
+			const size = view.getUint32(offset);
+			offset += 4;
+			handleFrame(buffer.slice(offset, offset + size), true);
+			offset += size;
+		}
+		noOlder = buffer.byteLength === 0;
+		history.scrollTop += history.scrollHeight - height;
+	} catch (e) {
+		console.error(e);
+	} finally {
+		loadingOlder = false;
+	}
+};
+const setReplyTo = time => {
+	replyTo = time;
+	const original = history.querySelector(` + "`" + `[data-time="${time}"]` + "`" + `);
+	replyTip.textContent = original ? ` + "`" + `Replying to ${original.querySelector('[slot=name]').textContent} ✕` + "`" + ` : '';
+	if (!original) {
+		replyTo = 0;
+	}
+};
+replyTip.addEventListener('click', () => setReplyTo(0));
+history.addEventListener('msg-action', ({ target, detail: { action, time } }) => {
+	switch (action) {
+	case 'jump':
+		history.querySelector(` + "`" + `[data-time="${time}"]` + "`" + `)?.scrollIntoView({ behavior: 'smooth', block: 'center' });
+		break;
+	case 'reply':
+		setReplyTo(time);
+		textarea.focus();
+		break;
+	case 'edit':
+		const text = prompt('Edit message', target.source);
+		if (ws && text?.trim()) {
+			ws.send(new Blob([Uint8Array.from([MsgType.Edit]), uint64(time), encoder.encode(text)]));
+		}
+		break;
+	case 'delete':
+		if (ws && confirm('Delete this message for everyone?')) {
+			ws.send(new Blob([Uint8Array.from([MsgType.Delete]), uint64(time)]));
+		}
+		break;
+	}
+});
+history.addEventListener('scroll', () => {
+	if (history.scrollTop < 64) {
+		loadOlder();
+	}
+});
+const connect = () => {
+	const params = new URLSearchParams({ protocol: protocolVersion, owner });
+	if (query.get('name')) {
+		params.set('name', query.get('name'));
+	}
+	if (room) {
+		params.set('room', room);
+	}
+	const password = sessionStorage.getItem(roomPasswordKey(room));
+	if (password) {
+		params.set('password', password);
+	}
+	if (epoch !== undefined) {
+		params.set('epoch', epoch);
+		params.set('since', lastSeq);
+	}
+	// take the files still held in fileHolder back over
+	if (server?.resume) {
+		params.set('resume', server.resume);
+	}
+	wsURL.search = params.toString();
+	ws = new WebSocket(wsURL.toString());
+	ws.addEventListener('open', () => {
+		connecting.style.display = 'none';
+		textarea.focus();
+		loadRooms();
+	});
+	ws.addEventListener('close', ({ code }) => {
+		ws = undefined;
+		connecting.style.display = '';
+		textarea.blur();
+		if (code === 4003) {
+			sessionStorage.removeItem(roomPasswordKey(room));
+			const password = prompt(` + "`" + `Password of room ${room}` + "`" + `);
+			if (password === null) {
+				switchRoom('');
+				return;
 			}
+			sessionStorage.setItem(roomPasswordKey(room), password);
+		}
+		if (code === 4002) {
+			// the server no longer speaks the protocol of this page
+			location.reload();
+			return;
 		}
-		history.insertBefore(msg, target);
-		if (scrollTimeout) {
-			clearTimeout(scrollTimeout);
+		if (code === 4004) {
+			// another connection took the session over
+			return;
+		}
+		if (code === 4000) {
+			alert('Invalid room name');
+			switchRoom('');
+			return;
 		}
-		scrollTimeout = setTimeout(() => {
-			msg.scrollIntoView({ behavior: 'smooth', block: 'nearest' });
-		}, 0.1e3);
+		setTimeout(async () => {
+			// the session expired, go through the login page again
+			const res = await fetch(location.href, { redirect: 'manual' }).catch(() => null);
+			if (res?.type === 'opaqueredirect') {
+				location.reload();
+				return;
+			}
+			connect();
+		}, 1e3);
 	});
+	// handled synchronously, so in the order the server sent them
+	ws.binaryType = 'arraybuffer';
+	ws.addEventListener('message', ({ data }) => handleFrame(data));
 };
 connect();
 const encoder = new TextEncoder();
@@ -293,11 +829,14 @@ form.addEventListener('submit', e => {
 	if (!ws) {
 		return;
 	}
-	const text = new FormData(e.target).get('text') || '';
-	e.target.reset();
+	const data = new FormData(e.target);
+	const text = data.get('text') || '';
+	const type = data.get('rich') ? MsgType.RichText : MsgType.Text;
+	textarea.value = '';
 	const u8arr = encoder.encode(text);
 	if (u8arr.length) {
-		ws.send(new Blob([Uint8Array.from([MsgType.Text]), u8arr]));
+		ws.send(direct([...(replyTo ? [Uint8Array.from([MsgType.Reply]), uint64(replyTo)] : []), Uint8Array.from([type]), u8arr]));
+		setReplyTo(0);
 	}
 });
 window.addEventListener('keydown', e => {
@@ -309,6 +848,12 @@ window.addEventListener('keydown', e => {
 		form.requestSubmit();
 	}
 });
+rename.addEventListener('click', () => {
+	const name = prompt('Your name', server && roster.get(server.session)?.name || '')?.trim();
+	if (ws && name) {
+		ws.send(new Blob([Uint8Array.from([MsgType.Rename]), encoder.encode(name)]));
+	}
+});
 let currentSelect;
 fileSelector.addEventListener('change', async () => {
 	if (!fileSelector.files.length) {
@@ -318,28 +863,51 @@ fileSelector.addEventListener('change', async () => {
 	case 'image':
 		for (const file of fileSelector.files) {
 			const u8arr = encoder.encode(file.type);
-			ws.send(new Blob([Uint8Array.from([MsgType.Image, u8arr.length]), u8arr, file]));
+			if (server && 2 + u8arr.length + file.size > server.limits.message) {
+				errorTip.textContent = ` + "`" + `${file.name} is too large for an image, send it as a file` + "`" + `;
+				continue;
+			}
+			ws.send(direct([Uint8Array.from([MsgType.Image, u8arr.length]), u8arr, file]));
 		}
 		break;
 	case 'file':
 		for (const file of fileSelector.files) {
 			const idRes = await fetch('/id');
-			const { id } = await idRes.json();
-			fileHolder[id] = {
+			const { id, epoch: fileEpoch, secret, store } = await idRes.json();
+			const holder = fileHolder[id] = {
 				name: file.name,
 				type: file.type,
 				size: file.size,
 				updated: file.lastModified,
+				epoch: fileEpoch,
+				secret,
 				file,
 			};
+			if (store) {
+				const query = new URLSearchParams({
+					name: file.name,
+					type: file.type,
+					epoch: fileEpoch,
+					secret,
+				});
+				const storeRes = await fetch(` + "`" + `/store/${id}?${query.toString()}` + "`" + `, {
+					method: 'POST',
+					headers: { 'Content-Type': file.type },
+					body: file,
+				}).catch(console.error);
+				// the server holds it now, otherwise keep relaying it from here
+				if (storeRes?.ok) {
+					holder.file = undefined;
+				}
+			}
 			const u8ID = new Uint8Array(4);
 			let tmpID = id;
 			for (let i = 3; i >= 0; --i) {
 				u8ID[i] = tmpID & 0xFF;
 				tmpID >>= 8;
 			}
-			const u8arr = encoder.encode(JSON.stringify(fileHolder[id], (k, v) => k === 'file' ? undefined : v));
-			ws.send(new Blob([Uint8Array.from([MsgType.File]), u8ID, u8arr]));
+			const u8arr = encoder.encode(JSON.stringify(holder, (k, v) => k === 'file' ? undefined : v));
+			ws.send(direct([Uint8Array.from([MsgType.File]), u8ID, u8arr]));
 		}
 		break;
 	}
@@ -356,14 +924,69 @@ file.addEventListener('click', () => {
 })();
 const messageTmpl = document.getElementById('message');
 const byteUnit = ['KiB', 'MiB', 'GiB'];
+// mirrors the tags kept by the server, the rest is rendered as text
+const richTextTags = new Set(['A', 'B', 'BLOCKQUOTE', 'BR', 'CODE', 'DEL', 'EM', 'I', 'LI', 'OL', 'P', 'PRE', 'S', 'STRONG', 'U', 'UL']);
+const safeProtocols = new Set(['http:', 'https:', 'mailto:']);
+const richTextNodes = (parent, source) => {
+	for (const node of source.childNodes) {
+		if (node.nodeType === Node.TEXT_NODE) {
+			parent.appendChild(document.createTextNode(node.data));
+			continue;
+		}
+		if (node.nodeType !== Node.ELEMENT_NODE) {
+			continue;
+		}
+		if (!richTextTags.has(node.tagName)) {
+			parent.appendChild(document.createTextNode(node.textContent));
+			continue;
+		}
+		const ele = document.createElement(node.tagName);
+		if (node.tagName === 'A') {
+			try {
+				const url = new URL(node.getAttribute('href'));
+				if (safeProtocols.has(url.protocol)) {
+					ele.href = url.href;
+					ele.target = '_blank';
+					ele.rel = 'noopener noreferrer';
+				}
+			} catch {}
+		}
+		richTextNodes(ele, node);
+		parent.appendChild(ele);
+	}
+};
+const cell = (row, content) => {
+	const td = document.createElement(row.parentNode?.tagName === 'THEAD' ? 'th' : 'td');
+	if (content instanceof Node) {
+		td.appendChild(content);
+	} else {
+		td.textContent = content;
+	}
+	row.appendChild(td);
+};
 window.customElements.define('lan-share-msg', class extends HTMLElement {
 	#main = null;
 	#url = null;
+	#preview = '';
+	// the text or HTML sent, offered for edition
+	source = '';
 	constructor() {
 		super();
 		this.attachShadow({ mode: 'open' });
 		this.shadowRoot.appendChild(messageTmpl.content.cloneNode(true));
 		this.#main = this.shadowRoot.querySelector('main');
+		// handled by the page, which knows the connection
+		const action = detail => this.dispatchEvent(new CustomEvent('msg-action', { bubbles: true, composed: true, detail }));
+		this.shadowRoot.querySelector('nav').addEventListener('click', ({ target }) => {
+			if (target.dataset.action) {
+				action({ action: target.dataset.action, time: Number(this.dataset.time) });
+			}
+		});
+		const quote = this.shadowRoot.querySelector('blockquote');
+		quote.addEventListener('click', () => action({ action: 'jump', time: Number(quote.dataset.time) }));
+	}
+	get preview() {
+		return this.#preview.slice(0, 80);
 	}
 	disconnectedCallback() {
 		this.release();
@@ -374,45 +997,81 @@ window.customElements.define('lan-share-msg', class extends HTMLElement {
 			this.#url = null;
 		}
 	}
+	setReply(time, preview) {
+		const quote = this.shadowRoot.querySelector('blockquote');
+		quote.dataset.time = time;
+		quote.textContent = preview;
+		quote.hidden = false;
+	}
+	setDeleted() {
+		this.release();
+		this.#preview = 'Deleted message';
+		this.#main.className = 'deleted';
+		this.#main.textContent = 'This message was deleted';
+		this.shadowRoot.querySelector('nav').hidden = true;
+	}
 	setText(text) {
 		this.release();
-		this.#main.innerHTML = text;
+		this.source = this.#preview = text;
+		this.dataset.editable = '';
+		this.#main.className = '';
+		this.#main.textContent = text;
+	}
+	setRichText(html) {
+		this.release();
+		this.source = html;
+		this.dataset.editable = '';
+		this.#main.className = 'rich';
+		this.#main.replaceChildren();
+		const doc = new DOMParser().parseFromString(html, 'text/html');
+		richTextNodes(this.#main, doc.body);
+		this.#preview = this.#main.textContent;
 	}
 	setImage(type, buffer) {
 		this.release();
 		this.#url = URL.createObjectURL(new Blob([buffer], { type }));
+		this.#preview = 'Image';
 		const image = new Image();
 		image.src = this.#url;
-		this.#main.innerHTML = '';
-		this.#main.appendChild(image);
+		this.#main.className = '';
+		this.#main.replaceChildren(image);
 	}
-	setFile(id, info) {
+	setFile(info, owner) {
 		this.release();
+		this.#preview = ` + "`" + `File ${info.name}` + "`" + `;
 		let sizeText = '';
 		for (let i = 0, size = info.size / 1024; size >= 1 && i < byteUnit.length; size /= 1024, ++i) {
 			sizeText = ` + "`" + `${size.toFixed(2)}${byteUnit[i]}` + "`" + `;
 		}
 		const date = new Date(info.updated);
-		this.#main.innerHTML = ` + "`" + `<table>
-<thead>
-<tr>
-	<th>Filename</th>
-	<th>Size</th>
-	<th>Type</th>
-	<th>Last Modified</th>
-	<th></th>
-</tr>
-</thead>
-<tbody>
-<tr>
-	<td>${info.name}</td>
-	<td>${sizeText ? ` + "`" + `${sizeText} (${info.size})` + "`" + ` : info.size}</td>
-	<td>${info.type}</td>
-	<td><time dateTime="${date.toJSON()}">${date.toLocaleString()}</time></td>
-	<td><a href="/download/${id}?open" target="_blank">Open</a> <a href="/download/${id}" download>Download</a></td>
-</tr>
-</tbody>
-		</table>` + "`" + `;
+		const table = document.createElement('table');
+		const head = table.createTHead().insertRow();
+		for (const title of ['Filename', 'Size', 'Type', 'Last Modified', '']) {
+			cell(head, title);
+		}
+		const row = table.createTBody().insertRow();
+		cell(row, String(info.name));
+		cell(row, sizeText ? ` + "`" + `${sizeText} (${info.size})` + "`" + ` : String(info.size));
+		cell(row, String(info.type));
+		const time = document.createElement('time');
+		time.dateTime = date.toJSON();
+		time.textContent = date.toLocaleString();
+		cell(row, time);
+		const links = document.createDocumentFragment();
+		const open = document.createElement('a');
+		// a private file is only served to the owners it was sent to
+		const query = owner ? ` + "`" + `owner=${encodeURIComponent(owner)}` + "`" + ` : '';
+		open.href = ` + "`" + `/download/${info.token}?open&${query}` + "`" + `;
+		open.target = '_blank';
+		open.textContent = 'Open';
+		const download = document.createElement('a');
+		download.href = ` + "`" + `/download/${info.token}?${query}` + "`" + `;
+		download.download = '';
+		download.textContent = 'Download';
+		links.append(open, ' ', download);
+		cell(row, links);
+		this.#main.className = '';
+		this.#main.replaceChildren(table);
 	}
 });
 </script>
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// localIPs returns the addresses of every running interface, except the
+// loopback and link-local ones.
+func localIPs() (ips []net.IP) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	for _, ifi := range interfaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return
+}
+
+// listenIPs returns the addresses the server is reachable on, according to
+// the addr flag.
+func listenIPs() []net.IP {
+	ip := net.ParseIP(strings.Trim(*address, "[]"))
+	if ip == nil || ip.IsUnspecified() {
+		return localIPs()
+	}
+	return []net.IP{ip}
+}
+
+// serverURLs returns the URLs the server is reachable on, the private IPv4
+// ones first since they are the most likely to work from a phone.
+func serverURLs(scheme string) []string {
+	ips := listenIPs()
+	rank := func(ip net.IP) int {
+		switch {
+		case ip.To4() != nil && ip.IsPrivate():
+			return 0
+		case ip.To4() != nil:
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(ips, func(i, j int) bool { return rank(ips[i]) < rank(ips[j]) })
+
+	urls := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		u := url.URL{Scheme: scheme, Host: net.JoinHostPort(ip.String(), strconv.Itoa(*port)), Path: "/"}
+		urls = append(urls, u.String())
+	}
+	return urls
+}
@@ -0,0 +1,55 @@
+package main
+
+const LoginPageTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<title>LAN-Share</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<style>
+	html, body {
+		margin: 0;
+		height: 100vh;
+		width: 100vw;
+	}
+	body {
+		display: flex;
+		align-items: center;
+		justify-content: center;
+	}
+	form {
+		display: grid;
+		grid-template: 32px 32px / 1fr 96px;
+		gap: 8px;
+		width: 320px;
+	}
+	input, button {
+		width: 100%;
+		height: 100%;
+		padding: 0 8px;
+		margin: 0;
+		box-sizing: border-box;
+		appearance: none;
+		border: 1px solid #ccc;
+		background-color: transparent;
+		outline: none;
+	}
+	button:hover {
+		background-color: #eee;
+		cursor: pointer;
+	}
+	#error {
+		grid-column: 1 / 3;
+		color: #c00;
+		line-height: 32px;
+	}
+</style>
+</head>
+<body>
+<form method="post" action="{{.Action}}">
+	<input name="password" type="password" placeholder="{{if .Admin}}Admin password{{else}}Password{{end}}" autofocus required>
+	<button type="submit">Login</button>
+	<input name="next" type="hidden" value="{{.Next}}">
+	<div id="error">{{.Error}}</div>
+</form>
+</body>
+</html>`
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"container/list"
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
@@ -11,38 +11,155 @@ import (
 	"os/signal"
 	"time"
 
+	"github.com/jinliming2/LAN-Share/protocol"
 	"github.com/jinliming2/LAN-Share/versions"
 )
 
 var (
-	maxChatHistory   = flag.Int("history", 999, "Chat history count, mind the memory usage")
+	maxChatHistory    = flag.Int("history", 999, "Chat history count, mind the memory usage, unlimited if 0")
+	maxHistoryBytes   = flag.Int("history-bytes", 256*1024*1024, "Total byte size of chat history, default to 256MiB, unlimited if 0")
+	historyTypeBudget = map[protocol.MsgType]*int{
+		protocol.MsgTypeText:  flag.Int("history-text-bytes", 0, "Byte size budget of text messages in chat history, unlimited if 0"),
+		protocol.MsgTypeImage: flag.Int("history-image-bytes", 0, "Byte size budget of image messages in chat history, unlimited if 0"),
+	}
 	messageSizeLimit = flag.Int("limit", 16*1024*1024, "The byte size limit per message, default to 16Mib, large file please send via 'file' option")
 	address          = flag.String("addr", "[::]", "Listen on address")
 	port             = flag.Int("port", 8080, "Listen on port")
 	version          = flag.Bool("version", false, "Show version and exit")
+	dataDir          = flag.String("data-dir", "", "Directory to persist chat history across restarts, disabled if empty")
+	fileDir          = flag.String("file-dir", "", "Directory to host shared files on the server so they outlive the sender, in a lan-share-files subdirectory cleared at startup, disabled if empty")
+	fileExpire       = flag.Duration("file-expire", 24*time.Hour, "How long a hosted file is kept")
+	fileGrace        = flag.Duration("file-grace", time.Minute, "How long the files of a dropped client stay offered for it to reconnect, disabled if 0")
+	relayCache       = flag.Int("relay-cache", 16*1024*1024, "Byte size of the relayed uploads kept in memory for the downloads joining them late, shared by all of them, default to 16MiB")
+	fileQuota        = flag.Int64("file-quota", 1024*1024*1024, "Total byte size of hosted files, default to 1GiB")
+	mdns             = flag.Bool("mdns", true, "Advertise the server as a DNS-SD service via multicast DNS")
+	mdnsName         = flag.String("mdns-name", "", "DNS-SD instance name, default to 'LAN Share on <hostname>'")
+	tlsCert          = flag.String("tls-cert", "", "TLS certificate file, serve HTTPS if given along with -tls-key")
+	tlsKey           = flag.String("tls-key", "", "TLS private key file")
+	tlsAuto          = flag.Bool("tls-auto", false, "Serve HTTPS with a cached self-signed certificate if -tls-cert is not given")
+	tlsRedirectPort  = flag.Int("tls-redirect-port", 0, "Listen on port for plain HTTP and redirect to HTTPS, disabled if 0")
+	printQR          = flag.Bool("qr", true, "Print a QR code of the server URL at startup")
+	password         = flag.String("password", "", "Password required to use the web UI, disabled if empty")
+	passwordFile     = flag.String("password-file", "", "File containing the password hash generated by -hash-password, overrides -password")
+	adminHashFile    = flag.String("admin-password-file", "", "File containing the password hash generated by -hash-password for the admins logging in at /admin to edit and delete any message, disabled if empty")
+	hashPasswordFlag = flag.Bool("hash-password", false, "Read a password from stdin, print its hash for -password-file and exit")
+	sessionExpire    = flag.Duration("session-expire", 7*24*time.Hour, "How long a login lasts")
+	roomIdle         = flag.Duration("room-idle", 10*time.Minute, "How long an empty room is kept before dropping its history")
+	sendQueueSize    = flag.Int("send-queue", 64, "Messages queued per client before the send-overflow policy applies")
+	pingInterval     = flag.Duration("ping-interval", 15*time.Second, "How often clients are pinged to detect dead connections, disabled if 0")
+	pingTimeout      = flag.Duration("ping-timeout", 10*time.Second, "How long to wait for a pong before dropping the client")
+	sendOverflow     = flag.String("send-overflow", overflowDisconnect, "What to do when a client's send queue is full, 'drop-oldest' or 'disconnect'")
+	roomFlags        roomSpecs
 
-	history = list.New()
+	shareURL string
 )
 
+func init() {
+	flag.Var(&roomFlags, "room", "Persistent room in the format of 'name[:hidden,password=xxx,history=n,history-bytes=n]', repeatable")
+}
+
 func main() {
 	flag.Parse()
 
+	if *hashPasswordFlag {
+		if err := hashPassword(os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	versions.PrintVersion()
 	if *version {
 		return
 	}
 
+	if *sendQueueSize < 1 || !validSendOverflow(*sendOverflow) {
+		log.Fatal("invalid -send-queue or -send-overflow")
+	}
+	if *pingInterval > 0 && *pingTimeout <= 0 {
+		log.Fatal("-ping-timeout must be positive")
+	}
+
+	if err := initRooms(roomFlags, *dataDir); err != nil {
+		log.Fatal(err)
+	}
+	if err := initAuth(); err != nil {
+		log.Fatal(err)
+	}
+	if *fileDir != "" {
+		if err := initFileStorage(*fileDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	server := &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", *address, *port),
-		Handler:      HTTPHandler,
+		Handler:      withAuth(HTTPHandler),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
-	serverError := make(chan error, 1)
+	if *tlsCert != "" || *tlsKey != "" || *tlsAuto {
+		cert, err := loadCertificate()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("TLS certificate SHA-256 fingerprint:", certFingerprint(cert))
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{*cert}}
+	}
+
+	scheme := "http"
+	if server.TLSConfig != nil {
+		scheme = "https"
+	}
+	urls := serverURLs(scheme)
+	for _, u := range urls {
+		log.Println("Open", u)
+	}
+	if len(urls) > 0 {
+		shareURL = urls[0]
+		if *printQR {
+			if code, err := encodeQR([]byte(shareURL)); err == nil {
+				code.WriteTerminal(os.Stdout)
+			}
+		}
+	}
+
+	var responder *mdnsResponder
+	if *mdns {
+		txt := []string{
+			"path=/",
+			"version=" + versions.VERSION,
+			"tls=" + onOff(server.TLSConfig != nil),
+			"auth=" + onOff(authEnabled()),
+		}
+		var err error
+		if responder, err = startMDNS(*mdnsName, *port, txt, listenIPs()); err != nil {
+			log.Println(err)
+		}
+	}
+
+	serverError := make(chan error, 2)
 	go func() {
 		log.Println("Server listing", server.Addr)
-		serverError <- server.ListenAndServe()
+		if server.TLSConfig != nil {
+			serverError <- server.ListenAndServeTLS("", "")
+		} else {
+			serverError <- server.ListenAndServe()
+		}
 	}()
+	var redirect *http.Server
+	if server.TLSConfig != nil && *tlsRedirectPort != 0 {
+		redirect = &http.Server{
+			Addr:         fmt.Sprintf("%s:%d", *address, *tlsRedirectPort),
+			Handler:      http.HandlerFunc(redirectHandler),
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		go func() {
+			log.Println("Redirecting HTTP to HTTPS on", redirect.Addr)
+			serverError <- redirect.ListenAndServe()
+		}()
+	}
 
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt)
@@ -63,7 +180,36 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatal(err)
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+	if redirect != nil {
+		if redirectErr := redirect.Shutdown(ctx); redirectErr != nil {
+			log.Println(redirectErr)
+			err = redirectErr
+		}
+	}
+	if responder != nil {
+		// sends the goodbye withdrawing the service before returning
+		responder.Close()
+	}
+	// given time of their own, the history is only closed once nothing
+	// writes to it anymore
+	wsCtx, wsCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer wsCancel()
+	if err := closeWebsockets(wsCtx); err != nil {
+		log.Println("Closing websockets:", err)
+	}
+	closeRooms()
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
 	}
+	return "off"
 }
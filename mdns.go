@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mdnsResponder advertises the server as a DNS-SD service over multicast DNS,
+// see RFC 6762 and RFC 6763.
+type mdnsResponder struct {
+	instance []string
+	service  []string
+	host     []string
+	port     uint16
+	txt      []string
+	ips      []net.IP
+
+	conns   []*net.UDPConn
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+const (
+	dnsTypeA    uint16 = 1
+	dnsTypePTR  uint16 = 12
+	dnsTypeTXT  uint16 = 16
+	dnsTypeAAAA uint16 = 28
+	dnsTypeSRV  uint16 = 33
+	dnsTypeANY  uint16 = 255
+
+	dnsClassIN         uint16 = 1
+	dnsClassCacheFlush uint16 = 1 << 15
+	dnsClassUnicast    uint16 = 1 << 15
+
+	mdnsPort      = 5353
+	mdnsHostTTL   = 120
+	mdnsOtherTTL  = 4500
+	mdnsLegacyTTL = 10
+)
+
+var (
+	mdnsGroupIPv4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+	mdnsGroupIPv6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: mdnsPort}
+
+	mdnsServices = []string{"_services", "_dns-sd", "_udp", "local"}
+
+	errDNSMalformed = errors.New("malformed DNS message")
+)
+
+type dnsQuestion struct {
+	name    []string
+	qtype   uint16
+	unicast bool
+}
+
+type dnsRecord struct {
+	name  []string
+	rtype uint16
+	flush bool
+	ttl   uint32
+	data  []byte
+}
+
+// startMDNS starts answering queries for the _http._tcp service named
+// instance, listening on port of every address in ips.
+func startMDNS(instance string, port int, txt []string, ips []net.IP) (*mdnsResponder, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	hostname = strings.SplitN(hostname, ".", 2)[0]
+	if instance == "" {
+		instance = "LAN Share on " + hostname
+	}
+
+	m := &mdnsResponder{
+		instance: []string{instance, "_http", "_tcp", "local"},
+		service:  []string{"_http", "_tcp", "local"},
+		host:     []string{mdnsLabel(hostname), "local"},
+		port:     uint16(port),
+		txt:      txt,
+		ips:      ips,
+		closing:  make(chan struct{}),
+	}
+
+	for _, group := range []*net.UDPAddr{mdnsGroupIPv4, mdnsGroupIPv6} {
+		network := "udp4"
+		if group.IP.To4() == nil {
+			network = "udp6"
+		}
+		conn, err := net.ListenMulticastUDP(network, nil, group)
+		if err != nil {
+			log.Println("mDNS:", err)
+			continue
+		}
+		m.conns = append(m.conns, conn)
+	}
+	if len(m.conns) == 0 {
+		return nil, errors.New("mDNS: no multicast socket available")
+	}
+
+	for _, conn := range m.conns {
+		m.wg.Add(1)
+		go m.serve(conn)
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		// announce twice, one second apart
+		for i := 0; i < 2; i++ {
+			m.announce(false)
+			select {
+			case <-m.closing:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+
+	return m, nil
+}
+
+// Close says goodbye to the network and stops the responder.
+func (m *mdnsResponder) Close() {
+	select {
+	case <-m.closing:
+		return
+	default:
+	}
+	close(m.closing)
+	m.announce(true)
+	for _, conn := range m.conns {
+		conn.Close()
+	}
+	m.wg.Wait()
+}
+
+func (m *mdnsResponder) serve(conn *net.UDPConn) {
+	defer m.wg.Done()
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-m.closing:
+			default:
+				log.Println("mDNS:", err)
+			}
+			return
+		}
+
+		id, questions, err := parseDNSQuery(buf[:n])
+		if err != nil || len(questions) == 0 {
+			continue
+		}
+
+		var answers, additionals []dnsRecord
+		unicast := false
+		for _, q := range questions {
+			answer, additional := m.answer(q)
+			answers = append(answers, answer...)
+			additionals = append(additionals, additional...)
+			unicast = unicast || q.unicast
+		}
+		if len(answers) == 0 {
+			continue
+		}
+
+		// legacy unicast resolvers query from ports other than 5353
+		legacy := src.Port != mdnsPort
+		if !legacy {
+			id = 0
+			questions = nil
+		} else {
+			for _, records := range [][]dnsRecord{answers, additionals} {
+				for i := range records {
+					records[i].flush = false
+					if records[i].ttl > mdnsLegacyTTL {
+						records[i].ttl = mdnsLegacyTTL
+					}
+				}
+			}
+		}
+		response := buildDNSResponse(id, questions, answers, additionals)
+
+		target := mdnsGroupIPv4
+		if src.IP.To4() == nil {
+			target = mdnsGroupIPv6
+		}
+		if unicast || legacy {
+			target = src
+		}
+		if _, err := conn.WriteToUDP(response, target); err != nil {
+			log.Println("mDNS:", err)
+		}
+	}
+}
+
+func (m *mdnsResponder) answer(q dnsQuestion) (answers, additionals []dnsRecord) {
+	match := func(records ...dnsRecord) {
+		for _, r := range records {
+			if q.qtype == r.rtype || q.qtype == dnsTypeANY {
+				answers = append(answers, r)
+			}
+		}
+	}
+	switch {
+	case dnsNameEqual(q.name, mdnsServices):
+		match(dnsRecord{mdnsServices, dnsTypePTR, false, mdnsOtherTTL, appendDNSName(nil, m.service)})
+	case dnsNameEqual(q.name, m.service):
+		match(m.ptrRecord())
+		additionals = append(m.instanceRecords(), m.hostRecords()...)
+	case dnsNameEqual(q.name, m.instance):
+		match(m.instanceRecords()...)
+		additionals = m.hostRecords()
+	case dnsNameEqual(q.name, m.host):
+		match(m.hostRecords()...)
+	}
+	if len(answers) == 0 {
+		additionals = nil
+	}
+	return
+}
+
+func (m *mdnsResponder) ptrRecord() dnsRecord {
+	return dnsRecord{m.service, dnsTypePTR, false, mdnsOtherTTL, appendDNSName(nil, m.instance)}
+}
+
+// instanceRecords returns the SRV and TXT records of the service instance.
+func (m *mdnsResponder) instanceRecords() []dnsRecord {
+	srv := make([]byte, 6)
+	binary.BigEndian.PutUint16(srv[4:], m.port)
+	srv = appendDNSName(srv, m.host)
+
+	var txt []byte
+	for _, item := range m.txt {
+		if len(item) > 255 {
+			item = item[:255]
+		}
+		txt = append(txt, byte(len(item)))
+		txt = append(txt, item...)
+	}
+	if len(txt) == 0 {
+		txt = []byte{0}
+	}
+
+	return []dnsRecord{
+		{m.instance, dnsTypeSRV, true, mdnsHostTTL, srv},
+		{m.instance, dnsTypeTXT, true, mdnsOtherTTL, txt},
+	}
+}
+
+func (m *mdnsResponder) hostRecords() (records []dnsRecord) {
+	for _, ip := range m.ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			records = append(records, dnsRecord{m.host, dnsTypeA, true, mdnsHostTTL, ip4})
+		} else {
+			records = append(records, dnsRecord{m.host, dnsTypeAAAA, true, mdnsHostTTL, ip.To16()})
+		}
+	}
+	return
+}
+
+// announce sends every record unsolicited, with zero TTL if goodbye.
+func (m *mdnsResponder) announce(goodbye bool) {
+	records := append([]dnsRecord{m.ptrRecord()}, m.instanceRecords()...)
+	records = append(records, m.hostRecords()...)
+	if goodbye {
+		for i := range records {
+			records[i].ttl = 0
+		}
+	}
+	response := buildDNSResponse(0, nil, records, nil)
+	for _, conn := range m.conns {
+		target := mdnsGroupIPv4
+		if conn.LocalAddr().(*net.UDPAddr).IP.To4() == nil {
+			target = mdnsGroupIPv6
+		}
+		if _, err := conn.WriteToUDP(response, target); err != nil {
+			log.Println("mDNS:", err)
+		}
+	}
+}
+
+func mdnsLabel(s string) string {
+	label := []byte(s)
+	for i, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			label[i] = '-'
+		}
+	}
+	if len(label) == 0 {
+		return "lan-share"
+	}
+	return string(label)
+}
+
+func dnsNameEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !strings.EqualFold(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseDNSQuery(msg []byte) (id uint16, questions []dnsQuestion, err error) {
+	if len(msg) < 12 {
+		return 0, nil, errDNSMalformed
+	}
+	id = binary.BigEndian.Uint16(msg)
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 != 0 {
+		// a response, not a query
+		return id, nil, nil
+	}
+	count := int(binary.BigEndian.Uint16(msg[4:]))
+	offset := 12
+	for i := 0; i < count; i++ {
+		var name []string
+		name, offset, err = readDNSName(msg, offset)
+		if err != nil {
+			return
+		}
+		if offset+4 > len(msg) {
+			return id, nil, errDNSMalformed
+		}
+		class := binary.BigEndian.Uint16(msg[offset+2:])
+		questions = append(questions, dnsQuestion{
+			name:    name,
+			qtype:   binary.BigEndian.Uint16(msg[offset:]),
+			unicast: class&dnsClassUnicast != 0,
+		})
+		offset += 4
+	}
+	return
+}
+
+// readDNSName reads a possibly compressed name at offset, and returns the
+// offset right after it.
+func readDNSName(msg []byte, offset int) (name []string, next int, err error) {
+	next = -1
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return nil, 0, errDNSMalformed
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return name, next, nil
+		case length&0xC0 == 0xC0:
+			if offset+2 > len(msg) || jumps > 16 {
+				return nil, 0, errDNSMalformed
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+			jumps++
+		case length&0xC0 != 0:
+			return nil, 0, errDNSMalformed
+		default:
+			if offset+1+length > len(msg) {
+				return nil, 0, errDNSMalformed
+			}
+			name = append(name, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+func appendDNSName(b []byte, name []string) []byte {
+	for _, label := range name {
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func buildDNSResponse(id uint16, questions []dnsQuestion, answers, additionals []dnsRecord) []byte {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg, id)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400) // response, authoritative
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(questions)))
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(msg[10:], uint16(len(additionals)))
+
+	for _, q := range questions {
+		msg = appendDNSName(msg, q.name)
+		msg = binary.BigEndian.AppendUint16(msg, q.qtype)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	}
+	for _, records := range [][]dnsRecord{answers, additionals} {
+		for _, r := range records {
+			class := dnsClassIN
+			if r.flush {
+				class |= dnsClassCacheFlush
+			}
+			msg = appendDNSName(msg, r.name)
+			msg = binary.BigEndian.AppendUint16(msg, r.rtype)
+			msg = binary.BigEndian.AppendUint16(msg, class)
+			msg = binary.BigEndian.AppendUint32(msg, r.ttl)
+			msg = binary.BigEndian.AppendUint16(msg, uint16(len(r.data)))
+			msg = append(msg, r.data...)
+		}
+	}
+	return msg
+}
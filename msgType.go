@@ -1,11 +0,0 @@
-package main
-
-type MsgType byte
-
-const (
-	MsgTypeText MsgType = iota
-	MsgTypeImage
-	MsgTypeFile
-	MsgTypeClearFile
-	MsgTypeRequestFile
-)
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/jinliming2/LAN-Share/protocol"
+)
+
+var errEmptyName = errors.New("empty name")
+
+// browserTokens and systemTokens label the devices by their user agent, the
+// first match wins so the more specific tokens come first.
+var (
+	browserTokens = [][2]string{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	}
+	systemTokens = [][2]string{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	}
+)
+
+// deviceLabel names the browser and system of a user agent, such as "Firefox
+// on Windows".
+func deviceLabel(userAgent string) string {
+	browser, system := matchToken(userAgent, browserTokens), matchToken(userAgent, systemTokens)
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	return "Unknown device"
+}
+
+func matchToken(userAgent string, tokens [][2]string) string {
+	for _, token := range tokens {
+		if strings.Contains(userAgent, token[0]) {
+			return token[1]
+		}
+	}
+	return ""
+}
+
+// session returns the presence record of cl.
+func (cl *client) session() protocol.Session {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return protocol.Session{
+		ID:     cl.id,
+		Name:   cl.name,
+		Addr:   cl.addr,
+		Device: cl.device,
+		Since:  cl.since.UnixMilli(),
+	}
+}
+
+// rename renames cl and tells the room.
+func (r *room) rename(cl *client, name string) error {
+	name = sanitizeName(name, "")
+	if name == "" {
+		return errEmptyName
+	}
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+
+	cl.mu.Lock()
+	cl.name = name
+	cl.mu.Unlock()
+	r.announce(protocol.PresenceRename, cl.session())
+	return nil
+}
+
+// announce sends a presence event to the clients speaking a protocol version
+// with presence. subscribersMu must be held.
+func (r *room) announce(event string, sessions ...protocol.Session) {
+	frame := protocol.EncodePresence(&protocol.Presence{Event: event, Sessions: sessions})
+	for _, cl := range r.subscribers {
+		if cl.protocol >= protocol.PresenceVersion {
+			cl.send(frame)
+		}
+	}
+}
+
+// roster returns the sessions in the room, the earliest first. subscribersMu
+// must be held.
+func (r *room) roster() []protocol.Session {
+	sessions := make([]protocol.Session, 0, len(r.subscribers))
+	for _, cl := range r.subscribers {
+		sessions = append(sessions, cl.session())
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Since != sessions[j].Since {
+			return sessions[i].Since < sessions[j].Since
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
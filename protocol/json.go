@@ -0,0 +1,204 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+// JSONSubprotocol is the websocket subprotocol exchanging the frames as JSON
+// objects in text messages, images being base64 encoded. The binary frames
+// are exchanged if it is not negotiated.
+const JSONSubprotocol = "lanshare.json.v1"
+
+var ErrMalformedJSON = errors.New("malformed JSON frame")
+
+var typeNames = map[MsgType]string{
+	MsgTypeText:        "text",
+	MsgTypeImage:       "image",
+	MsgTypeFile:        "file",
+	MsgTypeClearFile:   "clearFile",
+	MsgTypeRequestFile: "requestFile",
+	MsgTypeEvict:       "evict",
+	MsgTypeRichText:    "richText",
+	MsgTypeSync:        "sync",
+	MsgTypeError:       "error",
+	MsgTypeHello:       "hello",
+	MsgTypePresence:    "presence",
+	MsgTypeDeleted:     "deleted",
+	MsgTypeUpdate:      "update",
+}
+
+// JSONFrame is the JSON form of every frame, only the fields of its type are
+// set.
+type JSONFrame struct {
+	Type string `json:"type"`
+
+	// chat messages
+	Seq    uint64          `json:"seq,omitempty"`
+	Name   string          `json:"name,omitempty"`
+	Time   int64           `json:"time,omitempty"`
+	Text   string          `json:"text,omitempty"`
+	MIME   string          `json:"mime,omitempty"`
+	Data   []byte          `json:"data,omitempty"`
+	FileID uint32          `json:"fileId,omitempty"`
+	File   json.RawMessage `json:"file,omitempty"`
+	// set if addressed to sessions
+	From    string   `json:"from,omitempty"`
+	To      []string `json:"to,omitempty"`
+	ReplyTo int64    `json:"replyTo,omitempty"`
+
+	// delete and edit
+	ID int64 `json:"id,omitempty"`
+	// update, the new version of the message
+	Revision uint64     `json:"revision,omitempty"`
+	Update   *JSONFrame `json:"update,omitempty"`
+
+	// clearFile
+	FileIDs []uint32 `json:"fileIds,omitempty"`
+	// requestFile
+	Range string `json:"range,omitempty"`
+	// evict
+	Times []int64 `json:"times,omitempty"`
+	// sync
+	Reset    bool     `json:"reset,omitempty"`
+	Epoch    uint32   `json:"epoch,omitempty"`
+	Retained []uint64 `json:"retained,omitempty"`
+	// error
+	Code    ErrorCode `json:"code,omitempty"`
+	Message string    `json:"message,omitempty"`
+	// hello
+	Hello *Hello `json:"hello,omitempty"`
+	// presence
+	Presence *Presence `json:"presence,omitempty"`
+}
+
+// DecodeJSONMessage decodes and validates a JSON frame sent by a client, as
+// strictly as its binary form.
+func DecodeJSONMessage(data []byte) (*Message, error) {
+	var f JSONFrame
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, ErrMalformedJSON
+	}
+	m := &Message{Text: f.Text, MIME: f.MIME, Data: f.Data, FileID: f.FileID, FileInfo: f.File, To: f.To, ReplyTo: f.ReplyTo}
+	switch f.Type {
+	case "text":
+		m.Type = MsgTypeText
+	case "richText":
+		m.Type = MsgTypeRichText
+	case "image":
+		m.Type = MsgTypeImage
+	case "file":
+		m.Type = MsgTypeFile
+	case "rename":
+		m.Type, m.Text = MsgTypeRename, f.Name
+	case "delete":
+		m.Type, m.ID = MsgTypeDelete, f.ID
+	case "edit":
+		m.Type, m.ID = MsgTypeEdit, f.ID
+	default:
+		return nil, ErrUnexpectedType
+	}
+	frame, err := m.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return DecodeMessage(frame)
+}
+
+// FrameToJSON translates a frame sent by the server to its JSON form.
+func FrameToJSON(frame []byte) ([]byte, error) {
+	f, err := frameToJSON(frame)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(f)
+}
+
+func frameToJSON(frame []byte) (*JSONFrame, error) {
+	if len(frame) == 0 {
+		return nil, ErrEmptyFrame
+	}
+	mt := MsgType(frame[0])
+	f := &JSONFrame{Type: typeNames[mt]}
+	body := frame[1:]
+	switch mt {
+	case MsgTypeText, MsgTypeRichText, MsgTypeImage, MsgTypeFile, MsgTypeReply, MsgTypeDeleted:
+		c, err := DecodeChat(frame)
+		if err != nil {
+			return nil, err
+		}
+		f.setChat(c)
+	case MsgTypeDirect:
+		d, err := DecodeDirect(frame)
+		if err != nil {
+			return nil, err
+		}
+		f.setChat(&d.Chat)
+		f.From, f.To = d.From, d.To
+	case MsgTypeClearFile:
+		if len(body)%4 != 0 {
+			return nil, ErrTruncated
+		}
+		for ; len(body) > 0; body = body[4:] {
+			f.FileIDs = append(f.FileIDs, binary.BigEndian.Uint32(body))
+		}
+	case MsgTypeRequestFile:
+		if len(body) < 4 {
+			return nil, ErrTruncated
+		}
+		f.FileID, f.Range = binary.BigEndian.Uint32(body), string(body[4:])
+	case MsgTypeEvict:
+		if len(body)%8 != 0 {
+			return nil, ErrTruncated
+		}
+		for ; len(body) > 0; body = body[8:] {
+			f.Times = append(f.Times, int64(binary.BigEndian.Uint64(body)))
+		}
+	case MsgTypeSync:
+		if len(body) < 5 || (len(body)-5)%8 != 0 {
+			return nil, ErrTruncated
+		}
+		f.Reset, f.Epoch = body[0] == 1, binary.BigEndian.Uint32(body[1:])
+		for body = body[5:]; len(body) > 0; body = body[8:] {
+			f.Retained = append(f.Retained, binary.BigEndian.Uint64(body))
+		}
+	case MsgTypeError:
+		if len(body) < 1 {
+			return nil, ErrTruncated
+		}
+		f.Code, f.Message = ErrorCode(body[0]), string(body[1:])
+	case MsgTypeHello:
+		f.Hello = &Hello{}
+		if err := json.Unmarshal(body, f.Hello); err != nil {
+			return nil, ErrMalformedJSON
+		}
+	case MsgTypePresence:
+		f.Presence = &Presence{}
+		if err := json.Unmarshal(body, f.Presence); err != nil {
+			return nil, ErrMalformedJSON
+		}
+	case MsgTypeUpdate:
+		if len(body) < 9 {
+			return nil, ErrTruncated
+		}
+		if inner := MsgType(body[8]); !chatType(inner) && inner != MsgTypeReply && inner != MsgTypeDirect {
+			return nil, ErrUnexpectedType
+		}
+		update, err := frameToJSON(body[8:])
+		if err != nil {
+			return nil, err
+		}
+		f.Revision, f.Update = binary.BigEndian.Uint64(body), update
+	default:
+		return nil, ErrUnexpectedType
+	}
+	return f, nil
+}
+
+func (f *JSONFrame) setChat(c *Chat) {
+	f.Type = typeNames[c.Type]
+	f.Seq, f.Name, f.Time = c.Seq, c.Name, c.Time
+	f.Text, f.MIME, f.Data, f.FileID, f.File = c.Text, c.MIME, c.Data, c.FileID, c.FileInfo
+	f.ReplyTo = c.ReplyTo
+}
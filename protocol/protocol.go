@@ -0,0 +1,692 @@
+// Package protocol encodes and decodes the binary websocket frames exchanged
+// between LAN Share and its clients.
+//
+// A client sends a message as its type byte followed by the payload of the
+// type. The server relays it as a chat frame:
+//
+//	[type][8-byte seq][name length][name][8-byte unix ms][payload]
+//
+// All integers are big-endian. A message is identified by its timestamp,
+// which is unique per server. The payloads are:
+//
+//	Text, RichText: UTF-8 text
+//	Image:          [MIME length][MIME][image data]
+//	File:           [4-byte file id][JSON file info]
+//	Reply:          [8-byte id replied to][type][payload of the type]
+//	Deleted:        empty, the tombstone of a deleted message
+//
+// A client deletes or edits the text of one of its messages with
+//
+//	[Delete][8-byte id]
+//	[Edit][8-byte id][UTF-8 text]
+//
+// and the server relays the new version of the message to the clients as
+//
+//	[Update][8-byte revision][chat or Direct frame]
+//
+// the revision being a sequence number of the room, or 0 for Direct frames.
+//
+// A client renames itself by sending the Rename type followed by its new
+// name in UTF-8.
+//
+// A message addressed to sessions is sent by a client wrapped as
+//
+//	[Direct][count][id length][id]...[message]
+//
+// and relayed to them by the server as
+//
+//	[Direct][sender id length][sender id][count][id length][id]...[chat frame]
+//
+// The other frames are only ever sent by the server. Clients negotiating
+// JSONSubprotocol exchange the same frames as JSON instead.
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"unicode/utf8"
+)
+
+type MsgType byte
+
+const (
+	MsgTypeText MsgType = iota
+	MsgTypeImage
+	MsgTypeFile
+	MsgTypeClearFile
+	MsgTypeRequestFile
+	MsgTypeEvict
+	MsgTypeRichText
+	MsgTypeSync
+	MsgTypeError
+	MsgTypeHello
+	MsgTypePresence
+	MsgTypeRename
+	MsgTypeDirect
+	MsgTypeDelete
+	MsgTypeEdit
+	MsgTypeReply
+	MsgTypeDeleted
+	MsgTypeUpdate
+)
+
+// Version is the version of the protocol spoken by the server, clients which
+// speak an older version down to MinVersion are still served.
+const (
+	Version    = 4
+	MinVersion = 1
+
+	// PresenceVersion is the first version getting Presence frames.
+	PresenceVersion = 2
+	// DirectVersion is the first version getting Direct frames.
+	DirectVersion = 3
+	// EditVersion is the first version getting Update frames, replies and
+	// tombstones.
+	EditVersion = 4
+)
+
+// The events of a Presence frame.
+const (
+	PresenceSnapshot = "snapshot"
+	PresenceJoin     = "join"
+	PresenceLeave    = "leave"
+	PresenceRename   = "rename"
+)
+
+// ErrorCode tells a client why its frame was rejected.
+type ErrorCode byte
+
+const (
+	ErrorMalformed ErrorCode = iota + 1
+	ErrorUnexpectedType
+	ErrorInvalidContent
+	ErrorForbidden
+	ErrorNoRecipient
+)
+
+const (
+	MaxNameSize = 255
+	MaxMIMESize = 255
+
+	seqOffset  = 1
+	nameOffset = seqOffset + 8
+)
+
+var (
+	ErrEmptyFrame     = errors.New("empty frame")
+	ErrTruncated      = errors.New("truncated frame")
+	ErrUnexpectedType = errors.New("unexpected message type")
+	ErrEmptyPayload   = errors.New("empty payload")
+	ErrInvalidUTF8    = errors.New("text is not valid UTF-8")
+	ErrInvalidJSON    = errors.New("file info is not valid JSON")
+	ErrTooLong        = errors.New("field too long")
+	ErrNoRecipient    = errors.New("no recipient")
+	ErrInvalidID      = errors.New("invalid message id")
+)
+
+// Message is a chat message as sent by a client. Only the fields of its type
+// are set.
+type Message struct {
+	Type MsgType
+	// Text and RichText, or the new name of Rename
+	Text string
+	// Image
+	MIME string
+	Data []byte
+	// File
+	FileID   uint32
+	FileInfo []byte
+	// the sessions a Direct message is addressed to, nil for everyone
+	To []string
+	// the message replied to, 0 if none
+	ReplyTo int64
+	// the message to Delete or Edit, with the new text in Text
+	ID int64
+}
+
+// Chat is a message as relayed by the server.
+type Chat struct {
+	Message
+	Seq  uint64
+	Name string
+	// unix milliseconds, unique per server
+	Time int64
+}
+
+// Direct is a chat message relayed to the sessions it is addressed to.
+type Direct struct {
+	Chat
+	From string
+}
+
+// Sync starts the history replay on connect. The client starts over if Reset
+// is set, otherwise it keeps only the messages it has which are listed in
+// Retained. Epoch identifies the instance of the room numbering them.
+type Sync struct {
+	Reset    bool
+	Epoch    uint32
+	Retained []uint64
+}
+
+// Hello is the first frame sent on connect, telling a client what the server
+// supports. It is encoded as JSON after the type byte. Epoch identifies the
+// server instance issuing file ids.
+type Hello struct {
+	Protocol int             `json:"protocol"`
+	Server   string          `json:"server"`
+	Session  string          `json:"session"`
+	Resume   string          `json:"resume,omitempty"`
+	Admin    bool            `json:"admin,omitempty"`
+	Epoch    uint32          `json:"epoch"`
+	Limits   Limits          `json:"limits"`
+	Features map[string]bool `json:"features"`
+}
+
+// Limits are the sizes the server enforces, in bytes unless noted.
+type Limits struct {
+	Message  int `json:"message"`
+	Name     int `json:"name"`
+	FileName int `json:"fileName"`
+	// messages per history page
+	HistoryPage int `json:"historyPage"`
+}
+
+// Presence tells clients who is in the room, all of it on a snapshot and the
+// sessions concerned otherwise. It is encoded as JSON after the type byte.
+type Presence struct {
+	Event    string    `json:"event"`
+	Sessions []Session `json:"sessions"`
+}
+
+// Session describes a connected client.
+type Session struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Addr   string `json:"addr"`
+	Device string `json:"device"`
+	// unix milliseconds
+	Since int64 `json:"since"`
+}
+
+// DecodeMessage decodes and validates a frame sent by a client.
+func DecodeMessage(frame []byte) (*Message, error) {
+	if len(frame) == 0 {
+		return nil, ErrEmptyFrame
+	}
+	switch MsgType(frame[0]) {
+	case MsgTypeRename:
+		name, err := decodeText(frame[1:])
+		if err != nil {
+			return nil, err
+		}
+		return &Message{Type: MsgTypeRename, Text: name}, nil
+	case MsgTypeDelete:
+		id, rest, err := decodeID(frame[1:])
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) != 0 {
+			return nil, ErrTooLong
+		}
+		return &Message{Type: MsgTypeDelete, ID: id}, nil
+	case MsgTypeEdit:
+		id, rest, err := decodeID(frame[1:])
+		if err != nil {
+			return nil, err
+		}
+		text, err := decodeText(rest)
+		if err != nil {
+			return nil, err
+		}
+		return &Message{Type: MsgTypeEdit, ID: id, Text: text}, nil
+	case MsgTypeDeleted:
+		return nil, ErrUnexpectedType
+	case MsgTypeDirect:
+		to, rest, err := decodeIDs(frame[1:])
+		if err != nil {
+			return nil, err
+		}
+		if len(to) == 0 {
+			return nil, ErrNoRecipient
+		}
+		if len(rest) == 0 {
+			return nil, ErrEmptyFrame
+		}
+		if MsgType(rest[0]) == MsgTypeDeleted {
+			return nil, ErrUnexpectedType
+		}
+		m, err := decodePayload(MsgType(rest[0]), rest[1:])
+		if err != nil {
+			return nil, err
+		}
+		m.To = to
+		return m, nil
+	}
+	return decodePayload(MsgType(frame[0]), frame[1:])
+}
+
+// decodeIDs decodes a count prefixed list of length prefixed ids, returning
+// what follows it.
+func decodeIDs(data []byte) (ids []string, rest []byte, err error) {
+	if len(data) < 1 {
+		return nil, nil, ErrTruncated
+	}
+	count := int(data[0])
+	data = data[1:]
+	for i := 0; i < count; i++ {
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return nil, nil, ErrTruncated
+		}
+		end := 1 + int(data[0])
+		ids = append(ids, string(data[1:end]))
+		data = data[end:]
+	}
+	return ids, data, nil
+}
+
+func appendIDs(frame []byte, ids []string) ([]byte, error) {
+	if len(ids) > 255 {
+		return nil, ErrTooLong
+	}
+	frame = append(frame, byte(len(ids)))
+	for _, id := range ids {
+		if len(id) > 255 {
+			return nil, ErrTooLong
+		}
+		frame = append(frame, byte(len(id)))
+		frame = append(frame, id...)
+	}
+	return frame, nil
+}
+
+func decodeText(payload []byte) (string, error) {
+	if len(payload) == 0 {
+		return "", ErrEmptyPayload
+	}
+	if !utf8.Valid(payload) {
+		return "", ErrInvalidUTF8
+	}
+	return string(payload), nil
+}
+
+// decodeID decodes a message id, returning what follows it.
+func decodeID(data []byte) (int64, []byte, error) {
+	if len(data) < 8 {
+		return 0, nil, ErrTruncated
+	}
+	id := int64(binary.BigEndian.Uint64(data))
+	if id <= 0 {
+		return 0, nil, ErrInvalidID
+	}
+	return id, data[8:], nil
+}
+
+// decodePayload decodes the payload of a chat message type.
+func decodePayload(mt MsgType, payload []byte) (*Message, error) {
+	if mt == MsgTypeReply {
+		id, rest, err := decodeID(payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			return nil, ErrTruncated
+		}
+		if inner := MsgType(rest[0]); inner == MsgTypeReply || inner == MsgTypeDeleted {
+			return nil, ErrUnexpectedType
+		}
+		m, err := decodePayload(MsgType(rest[0]), rest[1:])
+		if err != nil {
+			return nil, err
+		}
+		m.ReplyTo = id
+		return m, nil
+	}
+	m := &Message{Type: mt}
+	switch mt {
+	case MsgTypeText, MsgTypeRichText:
+		text, err := decodeText(payload)
+		if err != nil {
+			return nil, err
+		}
+		m.Text = text
+	case MsgTypeImage:
+		if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+			return nil, ErrTruncated
+		}
+		end := 1 + int(payload[0])
+		m.MIME = string(payload[1:end])
+		m.Data = payload[end:]
+		if m.MIME == "" || len(m.Data) == 0 {
+			return nil, ErrEmptyPayload
+		}
+	case MsgTypeFile:
+		if len(payload) < 4 {
+			return nil, ErrTruncated
+		}
+		m.FileID = binary.BigEndian.Uint32(payload)
+		m.FileInfo = payload[4:]
+		if !json.Valid(m.FileInfo) {
+			return nil, ErrInvalidJSON
+		}
+	case MsgTypeDeleted:
+		if len(payload) != 0 {
+			return nil, ErrTooLong
+		}
+	default:
+		return nil, ErrUnexpectedType
+	}
+	return m, nil
+}
+
+// Encode returns the frame a client sends for m.
+func (m *Message) Encode() ([]byte, error) {
+	payload, err := m.payload()
+	if err != nil {
+		return nil, err
+	}
+	if m.To == nil {
+		return append([]byte{byte(m.frameType())}, payload...), nil
+	}
+	if len(m.To) == 0 {
+		return nil, ErrNoRecipient
+	}
+	if !chatType(m.Type) {
+		return nil, ErrUnexpectedType
+	}
+	frame, err := appendIDs([]byte{byte(MsgTypeDirect)}, m.To)
+	if err != nil {
+		return nil, err
+	}
+	frame = append(frame, byte(m.frameType()))
+	return append(frame, payload...), nil
+}
+
+// frameType returns the type byte starting the frame of m.
+func (m *Message) frameType() MsgType {
+	if m.ReplyTo != 0 {
+		return MsgTypeReply
+	}
+	return m.Type
+}
+
+func chatType(mt MsgType) bool {
+	switch mt {
+	case MsgTypeText, MsgTypeRichText, MsgTypeImage, MsgTypeFile, MsgTypeDeleted:
+		return true
+	}
+	return false
+}
+
+func (m *Message) payload() ([]byte, error) {
+	if m.ReplyTo != 0 {
+		if !chatType(m.Type) || m.Type == MsgTypeDeleted {
+			return nil, ErrUnexpectedType
+		}
+		inner := *m
+		inner.ReplyTo = 0
+		payload, err := inner.payload()
+		if err != nil {
+			return nil, err
+		}
+		prefix := binary.BigEndian.AppendUint64(make([]byte, 0, 9+len(payload)), uint64(m.ReplyTo))
+		return append(append(prefix, byte(m.Type)), payload...), nil
+	}
+	switch m.Type {
+	case MsgTypeText, MsgTypeRichText, MsgTypeRename:
+		return []byte(m.Text), nil
+	case MsgTypeDeleted:
+		return nil, nil
+	case MsgTypeDelete:
+		return binary.BigEndian.AppendUint64(nil, uint64(m.ID)), nil
+	case MsgTypeEdit:
+		return append(binary.BigEndian.AppendUint64(nil, uint64(m.ID)), m.Text...), nil
+	case MsgTypeImage:
+		if len(m.MIME) > MaxMIMESize {
+			return nil, ErrTooLong
+		}
+		payload := make([]byte, 0, 1+len(m.MIME)+len(m.Data))
+		payload = append(payload, byte(len(m.MIME)))
+		payload = append(payload, m.MIME...)
+		return append(payload, m.Data...), nil
+	case MsgTypeFile:
+		payload := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(m.FileInfo)), m.FileID)
+		return append(payload, m.FileInfo...), nil
+	}
+	return nil, ErrUnexpectedType
+}
+
+// EncodeChat returns the frame relaying c.
+func EncodeChat(c *Chat) ([]byte, error) {
+	if !chatType(c.Type) {
+		return nil, ErrUnexpectedType
+	}
+	if len(c.Name) > MaxNameSize {
+		return nil, ErrTooLong
+	}
+	payload, err := c.payload()
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 0, nameOffset+1+len(c.Name)+8+len(payload))
+	frame = append(frame, byte(c.frameType()))
+	frame = binary.BigEndian.AppendUint64(frame, c.Seq)
+	frame = append(frame, byte(len(c.Name)))
+	frame = append(frame, c.Name...)
+	frame = binary.BigEndian.AppendUint64(frame, uint64(c.Time))
+	return append(frame, payload...), nil
+}
+
+// DecodeChat decodes and validates a chat frame.
+func DecodeChat(frame []byte) (*Chat, error) {
+	if len(frame) == 0 {
+		return nil, ErrEmptyFrame
+	}
+	if len(frame) < nameOffset+1 || len(frame) < nameOffset+1+int(frame[nameOffset])+8 {
+		return nil, ErrTruncated
+	}
+	nameEnd := nameOffset + 1 + int(frame[nameOffset])
+	m, err := decodePayload(MsgType(frame[0]), frame[nameEnd+8:])
+	if err != nil {
+		return nil, err
+	}
+	return &Chat{
+		Message: *m,
+		Seq:     ChatSeq(frame),
+		Name:    string(frame[nameOffset+1 : nameEnd]),
+		Time:    ChatTime(frame),
+	}, nil
+}
+
+// EncodeDirect returns the frame relaying the chat frame sent by session from
+// to the sessions to.
+func EncodeDirect(from string, to []string, chat []byte) ([]byte, error) {
+	if len(from) > 255 {
+		return nil, ErrTooLong
+	}
+	frame := append([]byte{byte(MsgTypeDirect), byte(len(from))}, from...)
+	frame, err := appendIDs(frame, to)
+	if err != nil {
+		return nil, err
+	}
+	return append(frame, chat...), nil
+}
+
+// DecodeDirect decodes and validates a relayed Direct frame.
+func DecodeDirect(frame []byte) (*Direct, error) {
+	if len(frame) == 0 {
+		return nil, ErrEmptyFrame
+	}
+	if MsgType(frame[0]) != MsgTypeDirect {
+		return nil, ErrUnexpectedType
+	}
+	if len(frame) < 2 || len(frame) < 2+int(frame[1]) {
+		return nil, ErrTruncated
+	}
+	end := 2 + int(frame[1])
+	from := string(frame[2:end])
+	to, chat, err := decodeIDs(frame[end:])
+	if err != nil {
+		return nil, err
+	}
+	c, err := DecodeChat(chat)
+	if err != nil {
+		return nil, err
+	}
+	c.To = to
+	return &Direct{Chat: *c, From: from}, nil
+}
+
+// ChatSeq returns the sequence number of a valid chat frame.
+func ChatSeq(frame []byte) uint64 {
+	return binary.BigEndian.Uint64(frame[seqOffset:])
+}
+
+// SetChatSeq numbers a valid chat frame in place.
+func SetChatSeq(frame []byte, seq uint64) {
+	binary.BigEndian.PutUint64(frame[seqOffset:], seq)
+}
+
+// ChatTime returns the timestamp of a valid chat frame, which identifies it.
+func ChatTime(frame []byte) int64 {
+	offset := nameOffset + 1 + int(frame[nameOffset])
+	return int64(binary.BigEndian.Uint64(frame[offset:]))
+}
+
+// ChatType returns the message type of a valid chat frame, the one replied
+// with for a reply.
+func ChatType(frame []byte) MsgType {
+	if MsgType(frame[0]) != MsgTypeReply {
+		return MsgType(frame[0])
+	}
+	return MsgType(frame[nameOffset+1+int(frame[nameOffset])+8+8])
+}
+
+// EncodeUpdate returns the frame replacing a message by its new version.
+func EncodeUpdate(revision uint64, frame []byte) []byte {
+	update := binary.BigEndian.AppendUint64(make([]byte, 1, 9+len(frame)), revision)
+	update[0] = byte(MsgTypeUpdate)
+	return append(update, frame...)
+}
+
+// Downgrade returns frame the way a client speaking version understands it,
+// false if the client is not to get it at all.
+func Downgrade(frame []byte, version int) ([]byte, bool) {
+	if version >= Version || len(frame) == 0 {
+		return frame, true
+	}
+	switch MsgType(frame[0]) {
+	case MsgTypeDirect:
+		if version < DirectVersion {
+			return nil, false
+		}
+		if version < EditVersion {
+			return downgradeChat(frame), true
+		}
+	case MsgTypeReply, MsgTypeDeleted:
+		if version < EditVersion {
+			return downgradeChat(frame), true
+		}
+	case MsgTypeUpdate:
+		if version < EditVersion {
+			// an edit cannot be told, only a deletion
+			if evict := downgradeChat(frame[9:]); MsgType(evict[0]) == MsgTypeEvict {
+				return evict, true
+			}
+			return nil, false
+		}
+	}
+	return frame, true
+}
+
+// downgradeChat returns a valid chat frame, or Direct frame wrapping one, the
+// way a client before EditVersion understands it: a reply as the message
+// replied with, a tombstone as the Evict frame dropping the message.
+func downgradeChat(frame []byte) []byte {
+	var head []byte
+	chat := frame
+	if MsgType(frame[0]) == MsgTypeDirect {
+		_, chat, _ = decodeIDs(frame[2+int(frame[1]):])
+		head = frame[:len(frame)-len(chat)]
+	}
+	switch MsgType(chat[0]) {
+	case MsgTypeDeleted:
+		return EncodeEvict(ChatTime(chat))
+	case MsgTypeReply:
+		payload := nameOffset + 1 + int(chat[nameOffset]) + 8
+		message := append([]byte{chat[payload+8]}, chat[1:payload]...)
+		chat = append(message, chat[payload+9:]...)
+	}
+	return append(head[:len(head):len(head)], chat...)
+}
+
+// EncodeClearFile tells clients the files are no longer available.
+func EncodeClearFile(ids ...uint32) []byte {
+	frame := make([]byte, 1, 1+4*len(ids))
+	frame[0] = byte(MsgTypeClearFile)
+	for _, id := range ids {
+		frame = binary.BigEndian.AppendUint32(frame, id)
+	}
+	return frame
+}
+
+// EncodeRequestFile asks the sender of file id to upload the byte ranges of
+// an HTTP Range header, the whole file if empty.
+func EncodeRequestFile(id uint32, ranges string) []byte {
+	frame := binary.BigEndian.AppendUint32([]byte{byte(MsgTypeRequestFile)}, id)
+	return append(frame, ranges...)
+}
+
+// EncodeEvict tells clients to drop the messages with the timestamps.
+func EncodeEvict(times ...int64) []byte {
+	frame := make([]byte, 1, 1+8*len(times))
+	frame[0] = byte(MsgTypeEvict)
+	for _, t := range times {
+		frame = binary.BigEndian.AppendUint64(frame, uint64(t))
+	}
+	return frame
+}
+
+// EncodeSync returns the frame starting the history replay.
+func EncodeSync(s *Sync) []byte {
+	frame := make([]byte, 2, 6+8*len(s.Retained))
+	frame[0] = byte(MsgTypeSync)
+	if s.Reset {
+		frame[1] = 1
+	}
+	frame = binary.BigEndian.AppendUint32(frame, s.Epoch)
+	for _, seq := range s.Retained {
+		frame = binary.BigEndian.AppendUint64(frame, seq)
+	}
+	return frame
+}
+
+// EncodeHello returns the frame greeting a client.
+func EncodeHello(h *Hello) []byte {
+	data, _ := json.Marshal(h)
+	return append([]byte{byte(MsgTypeHello)}, data...)
+}
+
+// EncodePresence returns the frame telling clients who is in the room.
+func EncodePresence(p *Presence) []byte {
+	data, _ := json.Marshal(p)
+	return append([]byte{byte(MsgTypePresence)}, data...)
+}
+
+// EncodeError tells a client why its frame was rejected.
+func EncodeError(code ErrorCode, message string) []byte {
+	return append([]byte{byte(MsgTypeError), byte(code)}, message...)
+}
+
+// ErrorCodeOf returns the code reporting a decoding error.
+func ErrorCodeOf(err error) ErrorCode {
+	switch err {
+	case ErrUnexpectedType:
+		return ErrorUnexpectedType
+	case ErrEmptyPayload, ErrInvalidUTF8, ErrInvalidJSON, ErrTooLong:
+		return ErrorInvalidContent
+	case ErrNoRecipient:
+		return ErrorNoRecipient
+	}
+	return ErrorMalformed
+}
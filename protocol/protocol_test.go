@@ -0,0 +1,277 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func equalMessage(a, b *Message) bool {
+	return a.Type == b.Type && a.Text == b.Text && a.MIME == b.MIME &&
+		bytes.Equal(a.Data, b.Data) && a.FileID == b.FileID && bytes.Equal(a.FileInfo, b.FileInfo) &&
+		strings.Join(a.To, ",") == strings.Join(b.To, ",") && a.ReplyTo == b.ReplyTo && a.ID == b.ID
+}
+
+func TestDecodeMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  *Message
+		err   error
+	}{
+		{"empty", nil, nil, ErrEmptyFrame},
+		{"text", []byte("\x00hi"), &Message{Type: MsgTypeText, Text: "hi"}, nil},
+		{"empty text", []byte{0}, nil, ErrEmptyPayload},
+		{"invalid UTF-8", []byte("\x00\xff"), nil, ErrInvalidUTF8},
+		{"rich text", []byte("\x06<b>hi</b>"), &Message{Type: MsgTypeRichText, Text: "<b>hi</b>"}, nil},
+		{"image", []byte("\x01\x09image/png\x89PNG"), &Message{Type: MsgTypeImage, MIME: "image/png", Data: []byte("\x89PNG")}, nil},
+		{"image with the longest MIME", []byte("\x01\xff" + strings.Repeat("a", 255) + "x"), &Message{Type: MsgTypeImage, MIME: strings.Repeat("a", 255), Data: []byte("x")}, nil},
+		{"image without MIME length", []byte{1}, nil, ErrTruncated},
+		{"truncated MIME", []byte("\x01\x09image"), nil, ErrTruncated},
+		{"image without data", []byte("\x01\x09image/png"), nil, ErrEmptyPayload},
+		{"file", []byte("\x02\x00\x00\x01\x02{}"), &Message{Type: MsgTypeFile, FileID: 258, FileInfo: []byte("{}")}, nil},
+		{"truncated file id", []byte("\x02\x00\x00"), nil, ErrTruncated},
+		{"file info not JSON", []byte("\x02\x00\x00\x00\x01{"), nil, ErrInvalidJSON},
+		{"rename", []byte("\x0bbob"), &Message{Type: MsgTypeRename, Text: "bob"}, nil},
+		{"empty rename", []byte{11}, nil, ErrEmptyPayload},
+		{"direct", []byte("\x0c\x02\x01a\x02bc\x00hi"), &Message{Type: MsgTypeText, Text: "hi", To: []string{"a", "bc"}}, nil},
+		{"direct to nobody", []byte("\x0c\x00\x00hi"), nil, ErrNoRecipient},
+		{"truncated recipient", []byte("\x0c\x01\x05ab"), nil, ErrTruncated},
+		{"longest recipient", []byte("\x0c\x01\xff" + strings.Repeat("a", 255) + "\x00hi"), &Message{Type: MsgTypeText, Text: "hi", To: []string{strings.Repeat("a", 255)}}, nil},
+		{"direct rename", []byte("\x0c\x01\x01a\x0bbob"), nil, ErrUnexpectedType},
+		{"delete", []byte("\x0d\x00\x00\x00\x00\x00\x00\x01\x02"), &Message{Type: MsgTypeDelete, ID: 258}, nil},
+		{"delete id 0", []byte("\x0d\x00\x00\x00\x00\x00\x00\x00\x00"), nil, ErrInvalidID},
+		{"delete with trailing bytes", []byte("\x0d\x00\x00\x00\x00\x00\x00\x00\x01x"), nil, ErrTooLong},
+		{"edit", []byte("\x0e\x00\x00\x00\x00\x00\x00\x00\x01hi"), &Message{Type: MsgTypeEdit, ID: 1, Text: "hi"}, nil},
+		{"empty edit", []byte("\x0e\x00\x00\x00\x00\x00\x00\x00\x01"), nil, ErrEmptyPayload},
+		{"reply", []byte("\x0f\x00\x00\x00\x00\x00\x00\x00\x01\x00hi"), &Message{Type: MsgTypeText, Text: "hi", ReplyTo: 1}, nil},
+		{"reply with a tombstone", []byte("\x0f\x00\x00\x00\x00\x00\x00\x00\x01\x10"), nil, ErrUnexpectedType},
+		{"tombstone", []byte{16}, nil, ErrUnexpectedType},
+		{"server only type", []byte("\x03\x00\x00\x00\x01"), nil, ErrUnexpectedType},
+		{"unknown type", []byte{0xff}, nil, ErrUnexpectedType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := DecodeMessage(tt.frame)
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if tt.want != nil && !equalMessage(m, tt.want) {
+				t.Fatalf("got %+v, want %+v", m, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatRoundTrip(t *testing.T) {
+	c := &Chat{
+		Message: Message{Type: MsgTypeImage, MIME: "image/gif", Data: []byte("GIF89a")},
+		Seq:     42,
+		Name:    "alice",
+		Time:    1700000000000,
+	}
+	frame, err := EncodeChat(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ChatSeq(frame) != 42 || ChatTime(frame) != c.Time {
+		t.Fatalf("got seq %d time %d", ChatSeq(frame), ChatTime(frame))
+	}
+	SetChatSeq(frame, 43)
+	got, err := DecodeChat(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Seq != 43 || got.Name != c.Name || got.Time != c.Time || !equalMessage(&got.Message, &c.Message) {
+		t.Fatalf("got %+v, want %+v", got, c)
+	}
+}
+
+func TestReplyRoundTrip(t *testing.T) {
+	c := &Chat{Message: Message{Type: MsgTypeRichText, Text: "<b>hi</b>", ReplyTo: 7}, Seq: 2, Name: "bob", Time: 9}
+	frame, err := EncodeChat(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ChatType(frame) != MsgTypeRichText || ChatTime(frame) != 9 {
+		t.Fatalf("got type %d time %d", ChatType(frame), ChatTime(frame))
+	}
+	got, err := DecodeChat(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalMessage(&got.Message, &c.Message) {
+		t.Fatalf("got %+v, want %+v", got, c)
+	}
+}
+
+func TestDirectRoundTrip(t *testing.T) {
+	chat, _ := EncodeChat(&Chat{Message: Message{Type: MsgTypeText, Text: "hi"}, Name: "bob", Time: 5})
+	frame, err := EncodeDirect("me", []string{"you"}, chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := DecodeDirect(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.From != "me" || d.Name != "bob" || d.Time != 5 || !equalMessage(&d.Message, &Message{Type: MsgTypeText, Text: "hi", To: []string{"you"}}) {
+		t.Fatalf("got %+v", d)
+	}
+}
+
+func TestEncodeServerFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  []byte
+	}{
+		{"clear file", EncodeClearFile(1, 0x01020304), []byte{3, 0, 0, 0, 1, 1, 2, 3, 4}},
+		{"request file", EncodeRequestFile(7, "bytes=0-"), []byte("\x04\x00\x00\x00\x07bytes=0-")},
+		{"evict", EncodeEvict(258), []byte{5, 0, 0, 0, 0, 0, 0, 1, 2}},
+		{"sync", EncodeSync(&Sync{Reset: true, Epoch: 9, Retained: []uint64{1}}), []byte{7, 1, 0, 0, 0, 9, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{"error", EncodeError(ErrorForbidden, "no"), []byte("\x08\x04no")},
+		{"presence", EncodePresence(&Presence{Event: PresenceLeave, Sessions: []Session{{ID: "a"}}}), []byte("\x0a" + `{"event":"leave","sessions":[{"id":"a","name":"","addr":"","device":"","since":0}]}`)},
+		{"hello", EncodeHello(&Hello{Protocol: 1, Epoch: 3, Limits: Limits{Message: 2}}), []byte("\x09" + `{"protocol":1,"server":"","session":"","epoch":3,"limits":{"message":2,"name":0,"fileName":0,"historyPage":0},"features":null}`)},
+	}
+	for _, tt := range tests {
+		if !bytes.Equal(tt.frame, tt.want) {
+			t.Errorf("%s: got %x, want %x", tt.name, tt.frame, tt.want)
+		}
+	}
+}
+
+func TestDecodeJSONMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want *Message
+		err  error
+	}{
+		{"text", `{"type":"text","text":"hi"}`, &Message{Type: MsgTypeText, Text: "hi"}, nil},
+		{"image", `{"type":"image","mime":"image/png","data":"iVBORw=="}`, &Message{Type: MsgTypeImage, MIME: "image/png", Data: []byte("\x89PNG")}, nil},
+		{"file", `{"type":"file","fileId":258,"file":{}}`, &Message{Type: MsgTypeFile, FileID: 258, FileInfo: []byte("{}")}, nil},
+		{"rename", `{"type":"rename","name":"bob"}`, &Message{Type: MsgTypeRename, Text: "bob"}, nil},
+		{"direct", `{"type":"text","text":"hi","to":["a"]}`, &Message{Type: MsgTypeText, Text: "hi", To: []string{"a"}}, nil},
+		{"direct to nobody", `{"type":"text","text":"hi","to":[]}`, nil, ErrNoRecipient},
+		{"reply", `{"type":"text","text":"hi","replyTo":3}`, &Message{Type: MsgTypeText, Text: "hi", ReplyTo: 3}, nil},
+		{"delete", `{"type":"delete","id":3}`, &Message{Type: MsgTypeDelete, ID: 3}, nil},
+		{"edit", `{"type":"edit","id":3,"text":"hi"}`, &Message{Type: MsgTypeEdit, ID: 3, Text: "hi"}, nil},
+		{"not JSON", `{`, nil, ErrMalformedJSON},
+		{"empty text", `{"type":"text"}`, nil, ErrEmptyPayload},
+		{"server only type", `{"type":"sync"}`, nil, ErrUnexpectedType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := DecodeJSONMessage([]byte(tt.data))
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if tt.want != nil && !equalMessage(m, tt.want) {
+				t.Fatalf("got %+v, want %+v", m, tt.want)
+			}
+		})
+	}
+}
+
+func TestFrameToJSON(t *testing.T) {
+	chat, _ := EncodeChat(&Chat{Message: Message{Type: MsgTypeFile, FileID: 7, FileInfo: []byte(`{"name":"a"}`)}, Seq: 3, Name: "bob", Time: 5})
+	tombstone, _ := EncodeChat(&Chat{Message: Message{Type: MsgTypeDeleted}, Seq: 3, Name: "bob", Time: 5})
+	tests := []struct {
+		name  string
+		frame []byte
+		want  string
+	}{
+		{"update", EncodeUpdate(4, tombstone), `{"type":"update","revision":4,"update":{"type":"deleted","seq":3,"name":"bob","time":5}}`},
+		{"chat", chat, `{"type":"file","seq":3,"name":"bob","time":5,"fileId":7,"file":{"name":"a"}}`},
+		{"clear file", EncodeClearFile(1, 2), `{"type":"clearFile","fileIds":[1,2]}`},
+		{"sync", EncodeSync(&Sync{Reset: true, Epoch: 9, Retained: []uint64{1}}), `{"type":"sync","reset":true,"epoch":9,"retained":[1]}`},
+		{"error", EncodeError(ErrorForbidden, "no"), `{"type":"error","code":4,"message":"no"}`},
+		{"presence", EncodePresence(&Presence{Event: PresenceJoin}), `{"type":"presence","presence":{"event":"join","sessions":null}}`},
+	}
+	for _, tt := range tests {
+		got, err := FrameToJSON(tt.frame)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: got %s, %v, want %s", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestDowngrade(t *testing.T) {
+	chat, _ := EncodeChat(&Chat{Message: Message{Type: MsgTypeText, Text: "hi"}, Seq: 3, Name: "bob", Time: 5})
+	direct, _ := EncodeDirect("a", []string{"b"}, chat)
+	reply, _ := EncodeChat(&Chat{Message: Message{Type: MsgTypeText, Text: "hi", ReplyTo: 2}, Seq: 3, Name: "bob", Time: 5})
+	directReply, _ := EncodeDirect("a", []string{"b"}, reply)
+	tombstone, _ := EncodeChat(&Chat{Message: Message{Type: MsgTypeDeleted}, Seq: 3, Name: "bob", Time: 5})
+	edit, _ := EncodeChat(&Chat{Message: Message{Type: MsgTypeText, Text: "ho"}, Seq: 3, Name: "bob", Time: 5})
+	tests := []struct {
+		name    string
+		frame   []byte
+		version int
+		want    []byte
+		ok      bool
+	}{
+		{"chat", chat, MinVersion, chat, true},
+		{"direct", direct, DirectVersion, direct, true},
+		{"direct before DirectVersion", direct, DirectVersion - 1, nil, false},
+		{"reply", reply, EditVersion, reply, true},
+		{"reply before EditVersion", reply, EditVersion - 1, chat, true},
+		{"direct reply before EditVersion", directReply, EditVersion - 1, direct, true},
+		{"tombstone before EditVersion", tombstone, EditVersion - 1, EncodeEvict(5), true},
+		{"deletion before EditVersion", EncodeUpdate(4, tombstone), EditVersion - 1, EncodeEvict(5), true},
+		{"edit before EditVersion", EncodeUpdate(4, edit), EditVersion - 1, nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := Downgrade(tt.frame, tt.version)
+		if ok != tt.ok || !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %x, %v, want %x, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	f.Add([]byte("\x00hello"))
+	f.Add([]byte("\x06<b>hi</b>"))
+	f.Add([]byte("\x01\x09image/png\x89PNG"))
+	f.Add([]byte("\x01\xff" + strings.Repeat("a", 255) + "x"))
+	f.Add([]byte("\x02\x00\x00\x00\x01{\"name\":\"a\"}"))
+	f.Add([]byte{3})
+	f.Add([]byte("\x0bbob"))
+	f.Add([]byte("\x0c\x01\x01a\x00hi"))
+	f.Add([]byte("\x0e\x00\x00\x00\x00\x00\x00\x00\x01hi"))
+	f.Add([]byte("\x0f\x00\x00\x00\x00\x00\x00\x00\x01\x00hi"))
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		m, err := DecodeMessage(frame)
+		if err != nil {
+			return
+		}
+		// the format has no slack, so a valid frame encodes back as is
+		encoded, err := m.Encode()
+		if err != nil {
+			t.Fatalf("decoded %+v does not encode: %v", m, err)
+		}
+		if !bytes.Equal(encoded, frame) {
+			t.Fatalf("frame %x encodes back as %x", frame, encoded)
+		}
+	})
+}
+
+func FuzzDecodeChat(f *testing.F) {
+	seed, _ := EncodeChat(&Chat{Message: Message{Type: MsgTypeText, Text: "hi"}, Seq: 1, Name: "bob", Time: 1})
+	f.Add(seed)
+	seed, _ = EncodeChat(&Chat{Message: Message{Type: MsgTypeFile, FileID: 1, FileInfo: []byte("{}")}, Seq: 2, Time: 2})
+	f.Add(seed)
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		c, err := DecodeChat(frame)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeChat(c)
+		if err != nil {
+			t.Fatalf("decoded %+v does not encode: %v", c, err)
+		}
+		if !bytes.Equal(encoded, frame) {
+			t.Fatalf("frame %x encodes back as %x", frame, encoded)
+		}
+	})
+}
@@ -2,42 +2,74 @@ package main
 
 import (
 	"container/list"
-	"context"
-	"sync"
 
+	"github.com/jinliming2/LAN-Share/protocol"
 	"nhooyr.io/websocket"
 )
 
-var (
-	subscribers   = make(map[*websocket.Conn]interface{})
-	subscribersMu = sync.RWMutex{}
-)
+// addSubscriber subscribes cl, announcing it to the room and queueing the
+// roster to cl.
+func (r *room) addSubscriber(cl *client) {
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+	r.announce(protocol.PresenceJoin, cl.session())
+	r.subscribers[cl.conn] = cl
+	if cl.protocol >= protocol.PresenceVersion {
+		cl.send(protocol.EncodePresence(&protocol.Presence{Event: protocol.PresenceSnapshot, Sessions: r.roster()}))
+	}
+}
 
-func addSubscriber(subscriber *websocket.Conn) {
-	subscribersMu.Lock()
-	defer subscribersMu.Unlock()
-	subscribers[subscriber] = nil
+// delSubscriber unsubscribes and returns the number of subscribers left.
+func (r *room) delSubscriber(subscriber *websocket.Conn) int {
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+	if cl, ok := r.subscribers[subscriber]; ok {
+		delete(r.subscribers, subscriber)
+		r.announce(protocol.PresenceLeave, cl.session())
+	}
+	return len(r.subscribers)
 }
 
-func delSubscriber(subscriber *websocket.Conn) {
-	subscribersMu.Lock()
-	defer subscribersMu.Unlock()
-	delete(subscribers, subscriber)
+func (r *room) online() int {
+	r.subscribersMu.RLock()
+	defer r.subscribersMu.RUnlock()
+	return len(r.subscribers)
 }
 
-func publish(ctx context.Context, msg []byte, record bool) (msgObj *list.Element) {
-	subscribersMu.RLock()
-	defer subscribersMu.RUnlock()
+// subscriber returns the client of a subscribed connection.
+func (r *room) subscriber(subscriber *websocket.Conn) (*client, bool) {
+	r.subscribersMu.RLock()
+	defer r.subscribersMu.RUnlock()
+	cl, ok := r.subscribers[subscriber]
+	return cl, ok
+}
 
-	if record {
-		msgObj = history.PushBack(msg)
+// publish queues the notice msg to every subscriber.
+func (r *room) publish(msg []byte) {
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+	for _, cl := range r.subscribers {
+		cl.send(msg)
 	}
-	for history.Len() > *maxChatHistory {
-		history.Remove(history.Front())
+}
+
+// publishChat records the chat frame msg sent by cl in the history and
+// queues it to every subscriber.
+func (r *room) publishChat(cl *client, msg []byte) (msgObj *list.Element) {
+	// exclusive so every client gets the messages in sequence order
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+
+	msgObj, evicted := r.recordHistory(msg, cl.inbox)
+	for _, sub := range r.subscribers {
+		sub.send(msg)
 	}
 
-	for s := range subscribers {
-		s.Write(ctx, websocket.MessageBinary, msg)
+	if len(evicted) > 0 {
+		notice := evictMessage(evicted)
+		for _, sub := range r.subscribers {
+			sub.send(notice)
+		}
 	}
 
 	return
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// httpRange is a byte range of a file, end exclusive.
+type httpRange struct {
+	start, end int64
+}
+
+// rangePlan is how a relayed download is answered from the file metadata:
+// the whole file, one range of it, or several ones as multipart/byteranges.
+type rangePlan struct {
+	name        string
+	contentType string
+	size        int64
+	// ascending and apart, nil for the whole file
+	ranges   []httpRange
+	boundary string
+}
+
+// rangeGapLimit is the gap between two ranges beyond which the sender is
+// asked for them separately, rather than along with the bytes between them.
+const rangeGapLimit = 64 * 1024
+
+var (
+	errInvalidRange = errors.New("invalid range")
+	errNoOverlap    = errors.New("no range overlaps the file")
+)
+
+// newRangePlan plans the answer to the Range header of a download of the
+// file described by info.
+func newRangePlan(header string, info *fileInfo) (*rangePlan, error) {
+	p := &rangePlan{name: info.Name, contentType: info.Type, size: info.Size}
+	if p.contentType == "" {
+		p.contentType = "application/octet-stream"
+	}
+	ranges, err := parseRange(header, info.Size)
+	if err != nil {
+		return nil, err
+	}
+	p.ranges = coalesceRanges(ranges)
+	if len(p.ranges) > 1 {
+		p.boundary = multipart.NewWriter(nil).Boundary()
+	}
+	return p, nil
+}
+
+// parseRange parses a Range header against a file of size bytes, the way
+// http.ServeContent does. The ranges starting beyond the file are dropped,
+// errNoOverlap is returned if none is left.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errInvalidRange
+	}
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = textproto.TrimString(ra)
+		if ra == "" {
+			continue
+		}
+		start, end, ok := strings.Cut(ra, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		start, end = textproto.TrimString(start), textproto.TrimString(end)
+		var r httpRange
+		if start == "" {
+			// the last end bytes
+			if end == "" || end[0] == '-' {
+				return nil, errInvalidRange
+			}
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n == 0 {
+				noOverlap = true
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = httpRange{size - n, size}
+		} else {
+			n, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n >= size {
+				noOverlap = true
+				continue
+			}
+			r = httpRange{n, size}
+			if end != "" {
+				n, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > n {
+					return nil, errInvalidRange
+				}
+				if n < size {
+					r.end = n + 1
+				}
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// coalesceRanges sorts ranges and merges the overlapping and adjacent ones, so
+// they are served from a single pass over the file.
+func coalesceRanges(ranges []httpRange) []httpRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.start > last.end {
+			merged = append(merged, r)
+		} else if r.end > last.end {
+			last.end = r.end
+		}
+	}
+	return merged
+}
+
+// spans returns the bytes of the file the sender is asked to upload for the
+// plan, in order: the ranges, the ones close to each other sharing a span
+// with the bytes between them.
+func (p *rangePlan) spans() []httpRange {
+	if len(p.ranges) == 0 {
+		return []httpRange{{0, p.size}}
+	}
+	spans := []httpRange{p.ranges[0]}
+	for _, r := range p.ranges[1:] {
+		if last := &spans[len(spans)-1]; r.start-last.end <= rangeGapLimit {
+			last.end = r.end
+		} else {
+			spans = append(spans, r)
+		}
+	}
+	return spans
+}
+
+// span returns the Range header asking the sender of a file of size bytes
+// to upload r, empty for the whole file.
+func (r httpRange) span(size int64) string {
+	if r.start == 0 && r.end == size {
+		return ""
+	}
+	return "bytes=" + strconv.FormatInt(r.start, 10) + "-" + strconv.FormatInt(r.end-1, 10)
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return "bytes " + strconv.FormatInt(r.start, 10) + "-" + strconv.FormatInt(r.end-1, 10) + "/" + strconv.FormatInt(size, 10)
+}
+
+func (p *rangePlan) partHeader(r httpRange) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":  {p.contentType},
+		"Content-Range": {r.contentRange(p.size)},
+	}
+}
+
+// writeHeader writes the status and headers of the answer to the download r.
+func (p *rangePlan) writeHeader(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Content-Disposition", contentDisposition(r, p.name))
+	switch len(p.ranges) {
+	case 0:
+		h.Set("Content-Type", p.contentType)
+		h.Set("Content-Length", strconv.FormatInt(p.size, 10))
+		w.WriteHeader(http.StatusOK)
+	case 1:
+		h.Set("Content-Type", p.contentType)
+		h.Set("Content-Range", p.ranges[0].contentRange(p.size))
+		h.Set("Content-Length", strconv.FormatInt(p.ranges[0].end-p.ranges[0].start, 10))
+		w.WriteHeader(http.StatusPartialContent)
+	default:
+		h.Set("Content-Type", "multipart/byteranges; boundary="+p.boundary)
+		h.Set("Content-Length", strconv.FormatInt(p.multipartLength(), 10))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+}
+
+// unsatisfiable answers a download whose ranges all start beyond the file.
+func unsatisfiable(w http.ResponseWriter, size int64) {
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+	http.Error(w, errNoOverlap.Error(), http.StatusRequestedRangeNotSatisfiable)
+}
+
+func (p *rangePlan) multipartLength() int64 {
+	var n countingWriter
+	mw := multipart.NewWriter(&n)
+	mw.SetBoundary(p.boundary)
+	for _, r := range p.ranges {
+		mw.CreatePart(p.partHeader(r))
+		n += countingWriter(r.end - r.start)
+	}
+	mw.Close()
+	return int64(n)
+}
+
+// rangeBody turns the spans uploaded by the sender into the body of the
+// answer.
+type rangeBody interface {
+	io.WriteCloser
+	// skip moves on to offset of the file, past bytes in no range
+	skip(offset int64)
+}
+
+// body returns the writer turning the spans uploaded by the sender into the
+// body of the answer written to w.
+func (p *rangePlan) body(w io.Writer) rangeBody {
+	if len(p.ranges) < 2 {
+		return singleBody{w}
+	}
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(p.boundary)
+	return &partsWriter{plan: p, mw: mw, offset: p.ranges[0].start}
+}
+
+// partsWriter writes the ranges of a plan as the parts of a multipart body,
+// skipping the bytes between them.
+type partsWriter struct {
+	plan *rangePlan
+	mw   *multipart.Writer
+	part io.Writer
+	// the position in the file of the next byte written, and the range it
+	// falls in or before
+	offset int64
+	next   int
+}
+
+func (pw *partsWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 && pw.next < len(pw.plan.ranges) {
+		r := pw.plan.ranges[pw.next]
+		if pw.offset < r.start {
+			skip := min64(int64(len(b)), r.start-pw.offset)
+			b = b[skip:]
+			pw.offset += skip
+			continue
+		}
+		if pw.part == nil {
+			part, err := pw.mw.CreatePart(pw.plan.partHeader(r))
+			if err != nil {
+				return 0, err
+			}
+			pw.part = part
+		}
+		size := min64(int64(len(b)), r.end-pw.offset)
+		if _, err := pw.part.Write(b[:size]); err != nil {
+			return 0, err
+		}
+		b = b[size:]
+		pw.offset += size
+		if pw.offset == r.end {
+			pw.part = nil
+			pw.next++
+		}
+	}
+	return n, nil
+}
+
+func (pw *partsWriter) skip(offset int64) {
+	pw.offset = offset
+}
+
+// Close ends the multipart body once every range is written.
+func (pw *partsWriter) Close() error {
+	if pw.next < len(pw.plan.ranges) {
+		return io.ErrUnexpectedEOF
+	}
+	return pw.mw.Close()
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// singleBody is the body of the whole file or of a single range, uploaded
+// in a single span.
+type singleBody struct {
+	io.Writer
+}
+
+func (singleBody) Close() error {
+	return nil
+}
+
+func (singleBody) skip(int64) {}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
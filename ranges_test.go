@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   []httpRange
+		err    error
+	}{
+		{"none", "", nil, nil},
+		{"closed", "bytes=0-4", []httpRange{{0, 5}}, nil},
+		{"open", "bytes=5-", []httpRange{{5, 10}}, nil},
+		{"suffix", "bytes=-3", []httpRange{{7, 10}}, nil},
+		{"suffix longer than the file", "bytes=-20", []httpRange{{0, 10}}, nil},
+		{"end beyond the file", "bytes=8-20", []httpRange{{8, 10}}, nil},
+		{"several", "bytes=0-1, 4-5", []httpRange{{0, 2}, {4, 6}}, nil},
+		{"empty item", "bytes=0-1,,4-5", []httpRange{{0, 2}, {4, 6}}, nil},
+		{"one beyond the file", "bytes=10-,0-0", []httpRange{{0, 1}}, nil},
+		{"start beyond the file", "bytes=10-", nil, errNoOverlap},
+		{"empty suffix", "bytes=-0", nil, errNoOverlap},
+		{"other unit", "items=0-1", nil, errInvalidRange},
+		{"end before start", "bytes=5-4", nil, errInvalidRange},
+		{"no dash", "bytes=1", nil, errInvalidRange},
+		{"not a number", "bytes=a-", nil, errInvalidRange},
+		{"negative suffix", "bytes=--1", nil, errInvalidRange},
+	}
+	for _, tt := range tests {
+		got, err := parseRange(tt.header, 10)
+		if err != tt.err || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, %v, want %v, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestCoalesceRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []httpRange
+		want   []httpRange
+	}{
+		{"none", nil, nil},
+		{"apart", []httpRange{{4, 6}, {0, 2}}, []httpRange{{0, 2}, {4, 6}}},
+		{"overlapping", []httpRange{{3, 5}, {0, 4}}, []httpRange{{0, 5}}},
+		{"adjacent", []httpRange{{0, 2}, {2, 4}}, []httpRange{{0, 4}}},
+		{"contained", []httpRange{{0, 10}, {2, 4}, {12, 14}}, []httpRange{{0, 10}, {12, 14}}},
+	}
+	for _, tt := range tests {
+		if got := coalesceRanges(tt.ranges); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRangePlanSpans(t *testing.T) {
+	const size = 4 * rangeGapLimit
+	tests := []struct {
+		name   string
+		header string
+		want   []httpRange
+	}{
+		{"whole file", "", []httpRange{{0, size}}},
+		{"single range", "bytes=10-19", []httpRange{{10, 20}}},
+		{"close ranges", "bytes=0-0,100-100", []httpRange{{0, 101}}},
+		{"far ranges", "bytes=0-0,-1", []httpRange{{0, 1}, {size - 1, size}}},
+	}
+	for _, tt := range tests {
+		plan, err := newRangePlan(tt.header, &fileInfo{Name: "a", Size: size})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := plan.spans(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPartsWriter(t *testing.T) {
+	content := make([]byte, 3*rangeGapLimit)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	tests := []struct {
+		name   string
+		header string
+		want   []httpRange
+	}{
+		{"close ranges", "bytes=0-1,10-12,-2", []httpRange{{0, 2}, {10, 13}, {int64(len(content)) - 2, int64(len(content))}}},
+		{"overlapping ranges", "bytes=5-9,0-6", []httpRange{{0, 10}}},
+		{"far ranges", "bytes=0-0,100000-100009", []httpRange{{0, 1}, {100000, 100010}}},
+	}
+	for _, tt := range tests {
+		plan, err := newRangePlan(tt.header, &fileInfo{Name: "a", Type: "text/plain", Size: int64(len(content))})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(plan.ranges, tt.want) {
+			t.Errorf("%s: planned %v, want %v", tt.name, plan.ranges, tt.want)
+		}
+		if len(tt.want) == 1 {
+			if plan.boundary != "" {
+				t.Errorf("%s: single range sent as multipart", tt.name)
+			}
+			continue
+		}
+
+		var buf bytes.Buffer
+		body := plan.body(&buf)
+		for _, span := range plan.spans() {
+			body.skip(span.start)
+			// in uneven writes, as the chunks of a relay
+			for pos := span.start; pos < span.end; pos += 3 {
+				body.Write(content[pos:min64(pos+3, span.end)])
+			}
+		}
+		if err := body.Close(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if int64(buf.Len()) != plan.multipartLength() {
+			t.Errorf("%s: wrote %d bytes, announced %d", tt.name, buf.Len(), plan.multipartLength())
+		}
+
+		mr := multipart.NewReader(&buf, plan.boundary)
+		for i := 0; ; i++ {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				if i != len(tt.want) {
+					t.Errorf("%s: got %d parts, want %d", tt.name, i, len(tt.want))
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if i >= len(tt.want) {
+				t.Fatalf("%s: more than %d parts", tt.name, len(tt.want))
+			}
+			r := tt.want[i]
+			if got, want := part.Header.Get("Content-Range"), "bytes "+strconv.FormatInt(r.start, 10)+"-"+strconv.FormatInt(r.end-1, 10)+"/"+strconv.Itoa(len(content)); got != want {
+				t.Errorf("%s: part %d has range %q, want %q", tt.name, i, got, want)
+			}
+			if mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); mediaType != "text/plain" {
+				t.Errorf("%s: part %d has type %q", tt.name, i, mediaType)
+			}
+			if got, _ := io.ReadAll(part); !bytes.Equal(got, content[r.start:r.end]) {
+				t.Errorf("%s: part %d is %x, want %x", tt.name, i, got, content[r.start:r.end])
+			}
+		}
+	}
+}
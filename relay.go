@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinliming2/LAN-Share/protocol"
+)
+
+// relay is the upload of a span of a file by its sender, cached in memory so
+// every download within the span is served from it, including the ones
+// arriving once it has begun.
+type relay struct {
+	id     uint32
+	span   string
+	bounds httpRange
+	// waiting for the sender to reconnect to be asked for the span, guarded
+	// by relaysMu
+	queued bool
+
+	mu      sync.Mutex
+	started bool
+	// closed and replaced whenever the state below changes
+	changed chan struct{}
+	chunks  [][]byte
+	// offset of the first cached byte and after the last received one
+	base, written int64
+	cached        int64
+	finished      bool
+	err           error
+	readers       map[*relayReader]bool
+}
+
+// relayReader is a download served from a relay.
+type relayReader struct {
+	// offset of the next byte to send
+	pos int64
+}
+
+// relayedDownload is a download served from relays, reported in the metrics.
+type relayedDownload struct {
+	file  uint32
+	addr  string
+	since time.Time
+	sent  atomic.Int64
+}
+
+const relayChunkSize = 32 * 1024
+
+var (
+	relays   = make(map[uint32][]*relay)
+	relaysMu = sync.Mutex{}
+
+	// bytes cached by every relay, within -relay-cache
+	relayCached int64
+	// closed and replaced whenever cached bytes are released
+	relayReleased = make(chan struct{})
+	relayCacheMu  = sync.Mutex{}
+
+	downloads   = make(map[*relayedDownload]bool)
+	downloadsMu = sync.Mutex{}
+	// downloads moved to an upload of their own for falling behind
+	detachedDownloads atomic.Uint64
+
+	errNoReceiver  = errors.New("no download left")
+	errRelayGone   = errors.New("file no longer offered")
+	errSpanTooLong = errors.New("upload longer than the requested span")
+	errEvicted     = errors.New("bytes no longer cached")
+)
+
+// awaitRelay registers a download of bounds of file id to a relay, and waits
+// for its upload to begin.
+func awaitRelay(ctx context.Context, id uint32, bounds httpRange, size int64) (*relay, *relayReader, error) {
+	// held until the download is registered, so a reconnect sees it
+	resumptionsMu.Lock()
+	sender, ok := relaySource(id)
+	if !ok {
+		resumptionsMu.Unlock()
+		return nil, nil, errRelayGone
+	}
+	relaysMu.Lock()
+	rl, rd, created := joinRelay(id, bounds, bounds.span(size), sender == nil)
+	relaysMu.Unlock()
+	resumptionsMu.Unlock()
+
+	timeout := 5 * time.Second
+	if sender == nil {
+		// wait for the sender to reconnect, or for its files to be cleared
+		timeout += *fileGrace
+	} else if created {
+		sender.send(protocol.EncodeRequestFile(id, rl.span))
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := rl.waitStart(ctx); err != nil {
+		rl.leave(rd)
+		return nil, nil, err
+	}
+	return rl, rd, nil
+}
+
+// relaySource returns the client offering file id, nil if it waits for it to
+// reconnect. resumptionsMu must be held.
+func relaySource(id uint32) (*client, bool) {
+	fileRoomsMu.RLock()
+	room, ok := fileRooms[id]
+	fileRoomsMu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	room.fileSubscriberMu.RLock()
+	subscriber, ok := room.id2File[id]
+	room.fileSubscriberMu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	if sender, ok := room.subscriber(subscriber); ok {
+		return sender, true
+	}
+	return nil, suspended(subscriber)
+}
+
+// joinRelay registers a download of bounds of file id to the relay which
+// covers it and still caches its first byte, or to a new one asking the
+// sender for span. relaysMu must be held.
+func joinRelay(id uint32, bounds httpRange, span string, queued bool) (rl *relay, rd *relayReader, created bool) {
+	rd = &relayReader{pos: bounds.start}
+	for _, rl := range relays[id] {
+		rl.mu.Lock()
+		covered := rl.err == nil && bounds.start >= rl.base && bounds.end <= rl.bounds.end
+		if covered {
+			rl.readers[rd] = true
+		}
+		rl.mu.Unlock()
+		if covered {
+			return rl, rd, false
+		}
+	}
+	rl = &relay{
+		id:      id,
+		span:    span,
+		bounds:  bounds,
+		queued:  queued,
+		changed: make(chan struct{}),
+		base:    bounds.start,
+		written: bounds.start,
+		readers: map[*relayReader]bool{rd: true},
+	}
+	relays[id] = append(relays[id], rl)
+	return rl, rd, true
+}
+
+// startRelay returns the relay of file id waiting for the upload of span, nil
+// if there is none.
+func startRelay(id uint32, span string) *relay {
+	relaysMu.Lock()
+	defer relaysMu.Unlock()
+	for _, rl := range relays[id] {
+		if rl.span != span || rl.queued {
+			continue
+		}
+		rl.mu.Lock()
+		waiting := !rl.started && !rl.finished
+		if waiting {
+			rl.started = true
+			rl.notify()
+		}
+		rl.mu.Unlock()
+		if waiting {
+			return rl
+		}
+	}
+	return nil
+}
+
+// dropRelays ends the relays of file id, whose sender is gone. relaysMu must
+// be held.
+func dropRelays(id uint32) {
+	for _, rl := range relays[id] {
+		rl.mu.Lock()
+		rl.finish(errRelayGone)
+		rl.free()
+		rl.mu.Unlock()
+	}
+	delete(relays, id)
+}
+
+// removeRelay forgets rl, freeing its cache. relaysMu and rl.mu must be held.
+func removeRelay(rl *relay) {
+	rl.free()
+	list := relays[rl.id]
+	for i, r := range list {
+		if r == rl {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(relays, rl.id)
+	} else {
+		relays[rl.id] = list
+	}
+}
+
+// notify wakes the uploader and the downloads up. rl.mu must be held.
+func (rl *relay) notify() {
+	close(rl.changed)
+	rl.changed = make(chan struct{})
+}
+
+// finish ends the upload, with err if it did not complete. rl.mu must be
+// held.
+func (rl *relay) finish(err error) {
+	if rl.finished {
+		return
+	}
+	rl.finished = true
+	rl.err = err
+	rl.notify()
+}
+
+// wait returns once rl changes or ctx is done.
+func (rl *relay) wait(ctx context.Context, changed chan struct{}) error {
+	select {
+	case <-changed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitStart waits for the sender to begin the upload.
+func (rl *relay) waitStart(ctx context.Context) error {
+	for {
+		rl.mu.Lock()
+		started, err, changed := rl.started, rl.err, rl.changed
+		rl.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if started {
+			return nil
+		}
+		if err := rl.wait(ctx, changed); err != nil {
+			return err
+		}
+	}
+}
+
+// read returns the cached bytes from the offset of rd on, waiting for the
+// sender if none is received yet. errEvicted is returned once rd is detached.
+func (rl *relay) read(ctx context.Context, rd *relayReader) ([]byte, error) {
+	pos := rd.pos
+	for {
+		rl.mu.Lock()
+		if !rl.readers[rd] || pos < rl.base {
+			rl.mu.Unlock()
+			return nil, errEvicted
+		}
+		if pos < rl.written {
+			offset := rl.base
+			for _, chunk := range rl.chunks {
+				if pos < offset+int64(len(chunk)) {
+					rl.mu.Unlock()
+					return chunk[pos-offset:], nil
+				}
+				offset += int64(len(chunk))
+			}
+		}
+		finished, err, changed := rl.finished, rl.err, rl.changed
+		rl.mu.Unlock()
+		if finished {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if err := rl.wait(ctx, changed); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// advance records that rd sent the bytes before pos, which leave the cache
+// then if the other relays run short of it.
+func (rl *relay) advance(rd *relayReader, pos int64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rd.pos = pos
+	rl.trim(relayChunkSize)
+	rl.notify()
+}
+
+// leave unregisters rd, dropping rl once nobody waits for it any more.
+func (rl *relay) leave(rd *relayReader) {
+	relaysMu.Lock()
+	defer relaysMu.Unlock()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	delete(rl.readers, rd)
+	if len(rl.readers) == 0 && (!rl.started || rl.finished) {
+		rl.finish(errNoReceiver)
+		removeRelay(rl)
+	}
+	rl.notify()
+}
+
+// fill caches the upload body, making room by dropping the bytes every
+// download has sent. Once the cache is full, the slowest downloads are
+// detached if others wait for more bytes, otherwise it waits for them.
+func (rl *relay) fill(ctx context.Context, body io.Reader) error {
+	for {
+		buf := make([]byte, relayChunkSize)
+		n, err := io.ReadFull(body, buf)
+		if n > 0 {
+			if err := rl.append(ctx, buf[:n]); err != nil {
+				rl.end(err)
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			rl.mu.Lock()
+			complete := rl.written == rl.bounds.end
+			rl.mu.Unlock()
+			if !complete {
+				rl.end(io.ErrUnexpectedEOF)
+				return io.ErrUnexpectedEOF
+			}
+			rl.end(nil)
+			return nil
+		}
+		if err != nil {
+			rl.end(err)
+			return err
+		}
+	}
+}
+
+func (rl *relay) append(ctx context.Context, chunk []byte) error {
+	for {
+		rl.mu.Lock()
+		if len(rl.readers) == 0 {
+			rl.mu.Unlock()
+			return errNoReceiver
+		}
+		if rl.written+int64(len(chunk)) > rl.bounds.end {
+			rl.mu.Unlock()
+			return errSpanTooLong
+		}
+		rl.trim(int64(len(chunk)))
+		if !rl.fits(int64(len(chunk))) {
+			rl.detachLagging(int64(len(chunk)))
+		}
+		reserved, released := rl.reserve(int64(len(chunk)))
+		if reserved {
+			rl.chunks = append(rl.chunks, chunk)
+			rl.written += int64(len(chunk))
+			rl.notify()
+			rl.mu.Unlock()
+			return nil
+		}
+		changed := rl.changed
+		rl.mu.Unlock()
+		// room is made by the downloads of rl or by other relays
+		select {
+		case <-changed:
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// fits tells if n more bytes fit in the cache shared by every relay. An
+// empty relay may always cache a chunk, so that each one makes progress.
+// rl.mu must be held.
+func (rl *relay) fits(n int64) bool {
+	relayCacheMu.Lock()
+	defer relayCacheMu.Unlock()
+	return rl.cached == 0 || relayCached+n <= int64(*relayCache)
+}
+
+// reserve takes n bytes of the shared cache for rl if they fit, otherwise it
+// returns a channel closed once cached bytes are released. rl.mu must be
+// held.
+func (rl *relay) reserve(n int64) (bool, chan struct{}) {
+	relayCacheMu.Lock()
+	defer relayCacheMu.Unlock()
+	if rl.cached != 0 && relayCached+n > int64(*relayCache) {
+		return false, relayReleased
+	}
+	relayCached += n
+	rl.cached += n
+	return true, nil
+}
+
+// release returns n bytes cached by rl to the shared cache. rl.mu must be
+// held.
+func (rl *relay) release(n int64) {
+	relayCacheMu.Lock()
+	defer relayCacheMu.Unlock()
+	relayCached -= n
+	rl.cached -= n
+	close(relayReleased)
+	relayReleased = make(chan struct{})
+}
+
+// free releases the whole cache of rl, which is over. rl.mu must be held.
+func (rl *relay) free() {
+	rl.release(rl.cached)
+	rl.chunks = nil
+	rl.base = rl.written
+}
+
+// detachLagging detaches the slowest downloads while n more bytes do not fit
+// in the cache, if others are waiting for the upload, so they no longer hold
+// it up. rl.mu must be held.
+func (rl *relay) detachLagging(n int64) {
+	waiting := false
+	for rd := range rl.readers {
+		// including the ones which joined ahead of the upload
+		waiting = waiting || rd.pos >= rl.written
+	}
+	for waiting && !rl.fits(n) {
+		low := rl.written
+		for rd := range rl.readers {
+			if rd.pos < low {
+				low = rd.pos
+			}
+		}
+		if low == rl.written {
+			break
+		}
+		for rd := range rl.readers {
+			if rd.pos == low {
+				delete(rl.readers, rd)
+				detachedDownloads.Add(1)
+			}
+		}
+		rl.trim(n)
+	}
+	rl.notify()
+}
+
+// trim drops the oldest chunks sent by every download while n more bytes do
+// not fit in the cache. rl.mu must be held.
+func (rl *relay) trim(n int64) {
+	low := rl.written
+	for rd := range rl.readers {
+		if rd.pos < low {
+			low = rd.pos
+		}
+	}
+	for len(rl.chunks) > 0 && !rl.fits(n) {
+		size := int64(len(rl.chunks[0]))
+		if rl.base+size > low {
+			return
+		}
+		rl.chunks[0] = nil
+		rl.chunks = rl.chunks[1:]
+		rl.base += size
+		rl.release(size)
+	}
+}
+
+// end finishes the upload, and drops rl if every download is gone already.
+func (rl *relay) end(err error) {
+	relaysMu.Lock()
+	defer relaysMu.Unlock()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.finish(err)
+	if len(rl.readers) == 0 {
+		removeRelay(rl)
+	}
+}
+
+// track registers dl for the metrics until the returned function is called.
+func (dl *relayedDownload) track() func() {
+	downloadsMu.Lock()
+	defer downloadsMu.Unlock()
+	downloads[dl] = true
+	return func() {
+		downloadsMu.Lock()
+		defer downloadsMu.Unlock()
+		delete(downloads, dl)
+	}
+}
+
+// relayMetrics reports the relayed downloads in the Prometheus text format.
+func relayMetrics(w http.ResponseWriter) {
+	downloadsMu.Lock()
+	defer downloadsMu.Unlock()
+
+	fmt.Fprintln(w, "# HELP lan_share_relay_downloads Downloads relayed from their sender.")
+	fmt.Fprintln(w, "# TYPE lan_share_relay_downloads gauge")
+	fmt.Fprintln(w, "lan_share_relay_downloads", len(downloads))
+	relayCacheMu.Lock()
+	cached := relayCached
+	relayCacheMu.Unlock()
+	fmt.Fprintln(w, "# HELP lan_share_relay_cached_bytes Bytes of uploads cached by every relay.")
+	fmt.Fprintln(w, "# TYPE lan_share_relay_cached_bytes gauge")
+	fmt.Fprintln(w, "lan_share_relay_cached_bytes", cached)
+	fmt.Fprintln(w, "# HELP lan_share_relay_detached_total Downloads moved to an upload of their own for falling behind.")
+	fmt.Fprintln(w, "# TYPE lan_share_relay_detached_total counter")
+	fmt.Fprintln(w, "lan_share_relay_detached_total", detachedDownloads.Load())
+	fmt.Fprintln(w, "# HELP lan_share_relay_download_bytes Bytes sent to each relayed download.")
+	fmt.Fprintln(w, "# TYPE lan_share_relay_download_bytes gauge")
+	for dl := range downloads {
+		fmt.Fprintf(w, "lan_share_relay_download_bytes{file=\"%d\",addr=%q} %d\n", dl.file, dl.addr, dl.sent.Load())
+	}
+	fmt.Fprintln(w, "# HELP lan_share_relay_download_throughput_bytes Average bytes per second sent to each relayed download.")
+	fmt.Fprintln(w, "# TYPE lan_share_relay_download_throughput_bytes gauge")
+	for dl := range downloads {
+		fmt.Fprintf(w, "lan_share_relay_download_throughput_bytes{file=\"%d\",addr=%q} %.0f\n", dl.file, dl.addr, dl.throughput())
+	}
+}
+
+// throughput returns the bytes per second sent to dl.
+func (dl *relayedDownload) throughput() float64 {
+	return float64(dl.sent.Load()) / time.Since(dl.since).Seconds()
+}
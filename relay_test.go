@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRelayDetachesSlowReader(t *testing.T) {
+	defer func(size int) { *relayCache = size }(*relayCache)
+	*relayCache = 4 * relayChunkSize
+	content := make([]byte, 64*relayChunkSize)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	size := int64(len(content))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const id = 1
+	relaysMu.Lock()
+	rl, fast, _ := joinRelay(id, httpRange{0, size}, "", false)
+	joined, slow, _ := joinRelay(id, httpRange{0, size}, "", false)
+	relaysMu.Unlock()
+	if joined != rl {
+		t.Fatal("the second download did not join the relay")
+	}
+	if startRelay(id, "") != rl {
+		t.Fatal("the relay did not start")
+	}
+	detached := detachedDownloads.Load()
+	filled := make(chan error, 1)
+	go func() {
+		filled <- rl.fill(ctx, bytes.NewReader(content))
+	}()
+
+	// the slow download sends a chunk, then stalls
+	chunk, err := rl.read(ctx, slow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.advance(slow, int64(len(chunk)))
+
+	var got []byte
+	for pos := int64(0); pos < size; {
+		chunk, err := rl.read(ctx, fast)
+		if err != nil {
+			t.Fatalf("fast download at %d: %v", pos, err)
+		}
+		got = append(got, chunk...)
+		pos += int64(len(chunk))
+		rl.advance(fast, pos)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("the fast download got other bytes than uploaded")
+	}
+	if err := <-filled; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rl.read(ctx, slow); err != errEvicted {
+		t.Fatalf("the slow download got %v, want %v", err, errEvicted)
+	}
+	if n := detachedDownloads.Load() - detached; n != 1 {
+		t.Fatalf("%d downloads detached, want 1", n)
+	}
+
+	rl.leave(slow)
+	rl.leave(fast)
+	relaysMu.Lock()
+	_, left := relays[id]
+	relaysMu.Unlock()
+	relayCacheMu.Lock()
+	cached := relayCached
+	relayCacheMu.Unlock()
+	if left || cached != 0 {
+		t.Fatalf("relay left: %v, %d bytes still cached", left, cached)
+	}
+}
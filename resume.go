@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/jinliming2/LAN-Share/protocol"
+	"nhooyr.io/websocket"
+)
+
+// resumption keeps the files offered by a client through a connection drop:
+// the client reconnecting with its resume token takes them over, unless the
+// file-grace duration passes first.
+type resumption struct {
+	room *room
+	// the connection the files are registered to
+	conn *websocket.Conn
+	// running while conn is gone
+	expiry *time.Timer
+}
+
+const (
+	resumeTokenSize = 16
+
+	closeResumed websocket.StatusCode = 4004
+)
+
+var (
+	resumptions   = make(map[string]*resumption)
+	resumptionsMu = sync.Mutex{}
+)
+
+// resume returns the resume token of cl in r. If token was issued to an
+// earlier connection in r, cl takes its files over and keeps the token,
+// otherwise a new one is issued.
+func (r *room) resume(cl *client, token string) (string, error) {
+	resumptionsMu.Lock()
+	defer resumptionsMu.Unlock()
+
+	res, ok := resumptions[token]
+	if !ok || res.room != r {
+		b, err := randomBytes(resumeTokenSize)
+		if err != nil {
+			return "", err
+		}
+		token = base64.RawURLEncoding.EncodeToString(b)
+		resumptions[token] = &resumption{room: r, conn: cl.conn}
+		return token, nil
+	}
+
+	if res.expiry != nil {
+		res.expiry.Stop()
+		res.expiry = nil
+	} else {
+		// the client noticed the drop before the server did
+		go res.conn.Close(closeResumed, "resumed by another connection")
+	}
+	r.moveFiles(res.conn, cl)
+	res.conn = cl.conn
+	return token, nil
+}
+
+// suspend keeps the files of cl, which disconnected, for the file-grace
+// duration, or clears them right away if the client left on purpose.
+func (r *room) suspend(cl *client, left bool) {
+	resumptionsMu.Lock()
+	defer resumptionsMu.Unlock()
+
+	res, ok := resumptions[cl.resume]
+	if !ok || res.conn != cl.conn {
+		// taken over, only the files offered since then are left
+		r.clearFile(cl.conn)
+		return
+	}
+	if left || *fileGrace <= 0 || !r.hasFiles(cl.conn) {
+		delete(resumptions, cl.resume)
+		r.clearFile(cl.conn)
+		return
+	}
+	res.expiry = time.AfterFunc(*fileGrace, func() {
+		resumptionsMu.Lock()
+		defer resumptionsMu.Unlock()
+		// resume may have taken the lock before the timer was stopped
+		if res.conn == cl.conn {
+			delete(resumptions, cl.resume)
+			r.clearFile(cl.conn)
+		}
+	})
+}
+
+// resumedInbox returns the private history key of the connected client
+// holding resume token.
+func resumedInbox(token string) (string, bool) {
+	resumptionsMu.Lock()
+	res, ok := resumptions[token]
+	var conn *websocket.Conn
+	if ok {
+		conn = res.conn
+	}
+	resumptionsMu.Unlock()
+	if !ok {
+		return "", false
+	}
+	cl, ok := res.room.subscriber(conn)
+	if !ok {
+		return "", false
+	}
+	return cl.inbox, true
+}
+
+// suspended tells if the files of subscriber wait for it to reconnect.
+// resumptionsMu must be held.
+func suspended(subscriber *websocket.Conn) bool {
+	for _, res := range resumptions {
+		if res.conn == subscriber {
+			return res.expiry != nil
+		}
+	}
+	return false
+}
+
+func (r *room) hasFiles(subscriber *websocket.Conn) bool {
+	r.fileSubscriberMu.RLock()
+	defer r.fileSubscriberMu.RUnlock()
+	return len(r.file2Subscriber[subscriber]) > 0
+}
+
+// moveFiles registers the files of connection from to cl, and asks cl for
+// the ones downloads queued for meanwhile.
+func (r *room) moveFiles(from *websocket.Conn, cl *client) {
+	r.fileSubscriberMu.Lock()
+	defer r.fileSubscriberMu.Unlock()
+	files, ok := r.file2Subscriber[from]
+	if !ok {
+		return
+	}
+	delete(r.file2Subscriber, from)
+	r.file2Subscriber[cl.conn] = files
+
+	fileGrantsMu.Lock()
+	defer fileGrantsMu.Unlock()
+	relaysMu.Lock()
+	defer relaysMu.Unlock()
+	for id := range files {
+		r.id2File[id] = cl.conn
+		if grant, ok := fileGrants[id]; ok {
+			grant.sender = cl.conn
+		}
+		for _, rl := range relays[id] {
+			if rl.queued {
+				rl.queued = false
+				cl.send(protocol.EncodeRequestFile(id, rl.span))
+			}
+		}
+	}
+}
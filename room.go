@@ -0,0 +1,300 @@
+package main
+
+import (
+	"container/list"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jinliming2/LAN-Share/protocol"
+	"nhooyr.io/websocket"
+)
+
+// room is a channel with its own subscribers, history and files.
+type room struct {
+	name       string
+	hidden     bool
+	password   string
+	persistent bool
+
+	maxHistory      int
+	maxHistoryBytes int
+
+	subscribers   map[*websocket.Conn]*client
+	subscribersMu sync.RWMutex
+	// guarded by roomsMu
+	idleSince time.Time
+
+	history      *list.List
+	historyBytes int
+	// numbers its messages along with seq, a room collected and created
+	// again starts over from another epoch
+	epoch uint32
+	// sequence number of the latest message, and of the latest one evicted
+	seq              uint64
+	trimmedSeq       uint64
+	historyTypeBytes map[protocol.MsgType]int
+	historyMu        sync.Mutex
+	historyStorage   *historyStore
+	// messages addressed to sessions, never persisted, with the count and
+	// bytes of each inbox
+	private    *list.List
+	inboxLen   map[string]int
+	inboxBytes map[string]int
+
+	file2Subscriber  map[*websocket.Conn]map[uint32]*list.Element
+	id2File          map[uint32]*websocket.Conn
+	fileSubscriberMu sync.RWMutex
+}
+
+// roomSpec is a room configured with the room flag, in the format of
+// name[:option,...], options being hidden, password=xxx, history=n and
+// history-bytes=n.
+type roomSpec struct {
+	name            string
+	hidden          bool
+	password        string
+	maxHistory      int
+	maxHistoryBytes int
+}
+
+type roomSpecs []roomSpec
+
+const (
+	defaultRoom     = ""
+	maxRoomNameSize = 64
+
+	closeBadRoomName       websocket.StatusCode = 4000
+	closeWrongRoomPassword websocket.StatusCode = 4003
+)
+
+var (
+	rooms   = make(map[string]*room)
+	roomsMu = sync.Mutex{}
+
+	errRoomName          = errors.New("invalid room name")
+	errWrongRoomPassword = errors.New("wrong room password")
+	errNoRoom            = errors.New("no such room")
+)
+
+func newRoom(name string) *room {
+	return &room{
+		name:             name,
+		epoch:            newEpoch(),
+		maxHistory:       *maxChatHistory,
+		maxHistoryBytes:  *maxHistoryBytes,
+		subscribers:      make(map[*websocket.Conn]*client),
+		idleSince:        time.Now(),
+		history:          list.New(),
+		historyTypeBytes: make(map[protocol.MsgType]int),
+		private:          list.New(),
+		inboxLen:         make(map[string]int),
+		inboxBytes:       make(map[string]int),
+		file2Subscriber:  make(map[*websocket.Conn]map[uint32]*list.Element),
+		id2File:          make(map[uint32]*websocket.Conn),
+	}
+}
+
+// initRooms creates the default room and the configured ones, loading their
+// history from dataDir if set, and starts collecting idle rooms.
+func initRooms(specs roomSpecs, dataDir string) error {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+
+	specs = append(roomSpecs{{name: defaultRoom}}, specs...)
+	for _, spec := range specs {
+		r := newRoom(spec.name)
+		r.persistent = true
+		r.hidden = spec.hidden
+		r.password = spec.password
+		if spec.maxHistory > 0 {
+			r.maxHistory = spec.maxHistory
+		}
+		if spec.maxHistoryBytes > 0 {
+			r.maxHistoryBytes = spec.maxHistoryBytes
+		}
+		if dataDir != "" {
+			dir := filepath.Join(dataDir, "history")
+			if spec.name != defaultRoom {
+				dir = filepath.Join(dataDir, "rooms", url.PathEscape(spec.name), "history")
+			}
+			if err := r.loadHistory(dir); err != nil {
+				return err
+			}
+		}
+		rooms[spec.name] = r
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			collectRooms(time.Now())
+		}
+	}()
+	return nil
+}
+
+func closeRooms() {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	for _, r := range rooms {
+		r.closeHistory()
+	}
+}
+
+// joinRoom subscribes cl to the room, creating it with the given password and
+// visibility if it does not exist yet.
+func joinRoom(cl *client, name, password string, hidden bool) (*room, error) {
+	if !validRoomName(name) {
+		return nil, errRoomName
+	}
+
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+
+	r, ok := rooms[name]
+	if !ok {
+		r = newRoom(name)
+		r.hidden = hidden
+		r.password = password
+		rooms[name] = r
+		log.Printf("Room %q created", name)
+	} else if subtle.ConstantTimeCompare([]byte(password), []byte(r.password)) != 1 {
+		return nil, errWrongRoomPassword
+	}
+	r.addSubscriber(cl)
+	return r, nil
+}
+
+// findRoom returns the existing room name, given its password.
+func findRoom(name, password string) (*room, error) {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+
+	r, ok := rooms[name]
+	if !ok {
+		return nil, errNoRoom
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(r.password)) != 1 {
+		return nil, errWrongRoomPassword
+	}
+	return r, nil
+}
+
+func leaveRoom(r *room, c *websocket.Conn) {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	if r.delSubscriber(c) == 0 {
+		r.idleSince = time.Now()
+	}
+}
+
+// collectRooms drops the rooms nobody joined for the room-idle duration,
+// except the persistent ones.
+func collectRooms(now time.Time) {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+
+	for name, r := range rooms {
+		if r.persistent || r.online() > 0 || now.Sub(r.idleSince) < *roomIdle {
+			continue
+		}
+		delete(rooms, name)
+		log.Printf("Room %q collected", name)
+	}
+}
+
+type roomInfo struct {
+	Name       string `json:"name"`
+	Protected  bool   `json:"protected"`
+	Persistent bool   `json:"persistent"`
+	Online     int    `json:"online"`
+}
+
+// listRooms returns the rooms which are not hidden, ordered by name.
+func listRooms() []roomInfo {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+
+	infos := make([]roomInfo, 0, len(rooms))
+	for _, r := range rooms {
+		if r.hidden {
+			continue
+		}
+		infos = append(infos, roomInfo{r.name, r.password != "", r.persistent, r.online()})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// roomCloseStatus returns the close status telling the client why joinRoom
+// failed.
+func roomCloseStatus(err error) websocket.StatusCode {
+	if err == errWrongRoomPassword {
+		return closeWrongRoomPassword
+	}
+	return closeBadRoomName
+}
+
+func validRoomName(name string) bool {
+	if len(name) > maxRoomNameSize || strings.TrimSpace(name) != name {
+		return false
+	}
+	for _, c := range name {
+		if !unicode.IsPrint(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (specs *roomSpecs) String() string {
+	names := make([]string, len(*specs))
+	for i, spec := range *specs {
+		names[i] = spec.name
+	}
+	return strings.Join(names, " ")
+}
+
+func (specs *roomSpecs) Set(value string) error {
+	name, options, _ := strings.Cut(value, ":")
+	// the name of a persistent room is its directory under -data-dir,
+	// which must not be the rooms directory or its parent
+	if name == defaultRoom || name == "." || name == ".." || !validRoomName(name) {
+		return errRoomName
+	}
+	spec := roomSpec{name: name}
+	if options != "" {
+		for _, option := range strings.Split(options, ",") {
+			key, val, _ := strings.Cut(option, "=")
+			var err error
+			switch key {
+			case "hidden":
+				spec.hidden = true
+			case "password":
+				spec.password = val
+			case "history":
+				spec.maxHistory, err = strconv.Atoi(val)
+			case "history-bytes":
+				spec.maxHistoryBytes, err = strconv.Atoi(val)
+			default:
+				err = fmt.Errorf("unknown room option %q", key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	*specs = append(*specs, spec)
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jinliming2/LAN-Share/protocol"
+)
+
+// fileInfo is the metadata of a shared file, as shown to other clients.
+type fileInfo struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Size    int64  `json:"size"`
+	Updated int64  `json:"updated"`
+	// the server instance which issued the id
+	Epoch uint32 `json:"epoch"`
+	// the download token, set by the server
+	Token string `json:"token,omitempty"`
+	// the secret issued to the sender, never published
+	Secret string `json:"secret,omitempty"`
+}
+
+const (
+	maxNameSize     = 64
+	maxFileNameSize = 255
+	maxMIMESize     = 127
+	// rich text tags opened deeper are dropped, so closing a tag is cheap
+	maxRichTextDepth = 64
+)
+
+var (
+	mimeMatcher = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9!#$&^_.+-]*/[a-zA-Z0-9][a-zA-Z0-9!#$&^_.+-]*$`)
+	tagMatcher  = regexp.MustCompile(`^<(/?)([a-zA-Z][a-zA-Z0-9]*)((?:\s+[a-zA-Z_:][-a-zA-Z0-9_:.]*(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+))?)*)\s*/?>`)
+	attrMatcher = regexp.MustCompile(`([a-zA-Z_:][-a-zA-Z0-9_:.]*)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+)))?`)
+
+	// allowed rich text tags, and whether they are void elements
+	richTextTags = map[string]bool{
+		"a": false, "b": false, "blockquote": false, "br": true, "code": false,
+		"del": false, "em": false, "i": false, "li": false, "ol": false,
+		"p": false, "pre": false, "s": false, "strong": false, "u": false, "ul": false,
+	}
+
+	errEmptyMessage   = errors.New("empty message")
+	errBadFileInfo    = errors.New("malformed file metadata")
+	errBadMIME        = errors.New("malformed MIME type")
+	errUnexpectedType = errors.New("unexpected message type")
+)
+
+// sanitizeName normalizes a display name to printable UTF-8 of at most
+// maxNameSize bytes, fallback being used if nothing is left.
+func sanitizeName(name, fallback string) string {
+	name = truncateUTF8(strings.TrimSpace(printable(name)), maxNameSize)
+	if name == "" {
+		return truncateUTF8(fallback, maxNameSize)
+	}
+	return name
+}
+
+// sanitizeText returns valid UTF-8 text without control characters other
+// than line breaks and tabs.
+func sanitizeText(text []byte) ([]byte, error) {
+	s := stripControls(strings.ToValidUTF8(string(text), "�"))
+	if strings.TrimSpace(s) == "" {
+		return nil, errEmptyMessage
+	}
+	return []byte(s), nil
+}
+
+func stripControls(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || !unicode.IsControl(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// sanitizeFileInfo parses the file metadata sent by a client and encodes it
+// back with validated fields only.
+func sanitizeFileInfo(data []byte) ([]byte, error) {
+	var info fileInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, errBadFileInfo
+	}
+	info.Name = truncateUTF8(strings.TrimSpace(printable(info.Name)), maxFileNameSize)
+	if info.Name == "" || info.Size < 0 || info.Updated < 0 {
+		return nil, errBadFileInfo
+	}
+	if info.Type != "" && !validMIME(info.Type) {
+		info.Type = ""
+	}
+	info.Token = ""
+	return json.Marshal(info)
+}
+
+func validMIME(mime string) bool {
+	return len(mime) <= maxMIMESize && mimeMatcher.MatchString(mime)
+}
+
+// sanitizeRichText keeps a small set of formatting tags from the HTML in
+// text, rebuilding every kept tag from scratch and escaping everything else.
+// Unclosed tags are closed, stray closing tags and tags nested deeper than
+// maxRichTextDepth are dropped.
+func sanitizeRichText(text []byte) ([]byte, error) {
+	valid, err := sanitizeText(text)
+	if err != nil {
+		return nil, err
+	}
+	src := string(valid)
+
+	var sb strings.Builder
+	var open []string
+	flushText := func(s string) {
+		// entities may decode to control characters
+		sb.WriteString(html.EscapeString(stripControls(html.UnescapeString(s))))
+	}
+	for len(src) > 0 {
+		i := strings.IndexByte(src, '<')
+		if i < 0 {
+			flushText(src)
+			break
+		}
+		flushText(src[:i])
+		src = src[i:]
+
+		match := tagMatcher.FindStringSubmatch(src)
+		if match == nil {
+			sb.WriteString("&lt;")
+			src = src[1:]
+			continue
+		}
+		src = src[len(match[0]):]
+
+		name := strings.ToLower(match[2])
+		void, ok := richTextTags[name]
+		if !ok {
+			continue
+		}
+		if match[1] == "/" {
+			// close up to the matching open tag, if any
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] != name {
+					continue
+				}
+				for j := len(open) - 1; j >= i; j-- {
+					sb.WriteString("</" + open[j] + ">")
+				}
+				open = open[:i]
+				break
+			}
+			continue
+		}
+		if !void && len(open) == maxRichTextDepth {
+			continue
+		}
+
+		sb.WriteString("<" + name)
+		if name == "a" {
+			for _, attr := range attrMatcher.FindAllStringSubmatch(match[3], -1) {
+				if strings.ToLower(attr[1]) != "href" {
+					continue
+				}
+				href := html.UnescapeString(attr[2] + attr[3] + attr[4])
+				if safeURL(href) {
+					sb.WriteString(` href="` + html.EscapeString(href) + `"`)
+				}
+			}
+		}
+		sb.WriteString(">")
+		if !void {
+			open = append(open, name)
+		}
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		sb.WriteString("</" + open[i] + ">")
+	}
+
+	return []byte(sb.String()), nil
+}
+
+func safeURL(s string) bool {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) || r == ' ' {
+			return r
+		}
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		return -1
+	}, strings.ToValidUTF8(s, ""))
+}
+
+// truncateUTF8 truncates s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// normalizeMessage validates the content of a message sent by a client, and
+// normalizes it in place.
+func normalizeMessage(m *protocol.Message) error {
+	switch m.Type {
+	case protocol.MsgTypeText:
+		text, err := sanitizeText([]byte(m.Text))
+		if err != nil {
+			return err
+		}
+		m.Text = string(text)
+	case protocol.MsgTypeRichText:
+		text, err := sanitizeRichText([]byte(m.Text))
+		if err != nil {
+			return err
+		}
+		m.Text = string(text)
+	case protocol.MsgTypeImage:
+		if !validMIME(m.MIME) || !strings.HasPrefix(m.MIME, "image/") {
+			return errBadMIME
+		}
+	case protocol.MsgTypeFile:
+		info, err := sanitizeFileInfo(m.FileInfo)
+		if err != nil {
+			return err
+		}
+		m.FileInfo = info
+	default:
+		return errUnexpectedType
+	}
+	return nil
+}
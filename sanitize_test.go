@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeRichText(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain text", "hello", "hello"},
+		{"allowed tags", "<b>bold</b> <em>em</em><br>", "<b>bold</b> <em>em</em><br>"},
+		{"upper case tags", "<B>bold</B><BR/>", "<b>bold</b><br>"},
+		{"script", "<script>alert(1)</script>", "alert(1)"},
+		{"script in upper case", "<SCRIPT SRC=//evil.example></SCRIPT>", ""},
+		{"image with onerror", `<img src=x onerror="alert(1)">`, ""},
+		{"iframe", `<iframe src="https://evil.example"></iframe>x`, "x"},
+		{"event handler", `<b onclick="alert(1)">x</b>`, "<b>x</b>"},
+		{"style", `<p style="background:url(javascript:alert(1))">x</p>`, "<p>x</p>"},
+		{"attributes of a link", `<a href="https://a.example/" onmouseover=alert(1) target=_top>x</a>`, `<a href="https://a.example/">x</a>`},
+		{"link with entities", `<a href="https://a.example/?a=1&amp;b=&quot;2">x</a>`, `<a href="https://a.example/?a=1&amp;b=&#34;2">x</a>`},
+		{"single quoted link", `<a href='mailto:a@example.com'>x</a>`, `<a href="mailto:a@example.com">x</a>`},
+		{"unquoted link", `<a href=http://a.example/>x</a>`, `<a href="http://a.example/">x</a>`},
+		{"javascript link", `<a href="javascript:alert(1)">x</a>`, "<a>x</a>"},
+		{"mixed case javascript link", `<a href="JaVaScRiPt:alert(1)">x</a>`, "<a>x</a>"},
+		{"javascript link after spaces", `<a href="  javascript:alert(1)">x</a>`, "<a>x</a>"},
+		{"decimal entity javascript link", `<a href="&#106;avascript:alert(1)">x</a>`, "<a>x</a>"},
+		{"hex entity javascript link", `<a href="&#x6A;&#x61;vascript:alert(1)">x</a>`, "<a>x</a>"},
+		{"named entity javascript link", `<a href="javascript&colon;alert(1)">x</a>`, "<a>x</a>"},
+		{"tab in javascript link", `<a href="java&#x09;script:alert(1)">x</a>`, "<a>x</a>"},
+		{"data link", `<a href="data:text/html;base64,PHNjcmlwdD4=">x</a>`, "<a>x</a>"},
+		{"upper case data link", `<a href="DATA:text/html,<script>alert(1)</script>">x</a>`, "<a>x</a>"},
+		{"vbscript link", `<a href="vbscript:msgbox(1)">x</a>`, "<a>x</a>"},
+		{"mixed case vbscript link", `<a href="VbScript:msgbox(1)">x</a>`, "<a>x</a>"},
+		{"relative link", `<a href="/logout">x</a>`, "<a>x</a>"},
+		{"unclosed tags", "<b><i>x", "<b><i>x</i></b>"},
+		{"misnested tags", "<b><i>x</b>y</i>", "<b><i>x</i></b>y"},
+		{"stray closing tag", "</i>x</ul>", "x"},
+		{"nested lists", "<ul><li>a<ol><li>b</ol></ul>", "<ul><li>a<ol><li>b</li></ol></li></ul>"},
+		{"unterminated tag", "<b", "&lt;b"},
+		{"comparison", "a < b > c", "a &lt; b &gt; c"},
+		{"escaped markup", "&lt;script&gt;alert(1)&lt;/script&gt;", "&lt;script&gt;alert(1)&lt;/script&gt;"},
+		{"comment", "<!-- <b> -->x", "&lt;!-- <b> --&gt;x</b>"},
+		{"control characters", "a\x00b\x1bc", "abc"},
+		{"escaped control characters", "a&#11;b&#x1b;c", "abc"},
+	}
+	for _, tt := range tests {
+		got, err := sanitizeRichText([]byte(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeRichTextEmpty(t *testing.T) {
+	for _, in := range []string{"", " \n\t", "\x00"} {
+		if _, err := sanitizeRichText([]byte(in)); err != errEmptyMessage {
+			t.Errorf("%q: got %v, want %v", in, err, errEmptyMessage)
+		}
+	}
+}
+
+func TestSanitizeRichTextOversized(t *testing.T) {
+	// only maxRichTextDepth tags are kept open
+	got, err := sanitizeRichText([]byte(strings.Repeat("<b>", maxRichTextDepth+10) + "x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("<b>", maxRichTextDepth) + "x" + strings.Repeat("</b>", maxRichTextDepth); string(got) != want {
+		t.Errorf("deep nesting: got %d bytes, want %d", len(got), len(want))
+	}
+
+	// stray closing tags deep in open ones, which took quadratic time
+	n := 1 << 16
+	got, err = sanitizeRichText([]byte(strings.Repeat("<i>", n) + strings.Repeat("</b>", n) + strings.Repeat("<br>", n)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("<i>", maxRichTextDepth) + strings.Repeat("<br>", n) + strings.Repeat("</i>", maxRichTextDepth); string(got) != want {
+		t.Errorf("stray closing tags: got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func FuzzSanitizeRichText(f *testing.F) {
+	f.Add("<b>hi</b>")
+	f.Add(`<a href="https://a.example/" onclick=x>x</a>`)
+	f.Add(`<a href="&#106;avascript:alert(1)">x</a>`)
+	f.Add("<ul><li>a<li>b</ul></i>")
+	f.Add("<script>alert(1)</script><b")
+	f.Fuzz(func(t *testing.T, in string) {
+		got, err := sanitizeRichText([]byte(in))
+		if err != nil || len(strings.TrimSpace(string(got))) == 0 {
+			return
+		}
+		// whatever is kept is kept again as is
+		again, err := sanitizeRichText(got)
+		if err != nil {
+			t.Fatalf("%q sanitized as %q which is rejected: %v", in, got, err)
+		}
+		if string(again) != string(got) {
+			t.Fatalf("%q sanitized as %q, then as %q", in, got, again)
+		}
+		lower := strings.ToLower(string(got))
+		for _, bad := range []string{"<script", "<img", "<iframe", "<style", " on", "style=", "javascript:", "vbscript:", "data:"} {
+			if strings.Contains(lower, bad) && !strings.Contains(strings.ToLower(in), bad) {
+				t.Fatalf("%q sanitized as %q containing %q", in, got, bad)
+			}
+		}
+		if strings.Contains(lower, `href="javascript`) || strings.Contains(lower, `href="data`) || strings.Contains(lower, `href="vbscript`) {
+			t.Fatalf("%q sanitized as %q with an unsafe link", in, got)
+		}
+	})
+}
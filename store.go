@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// historyStore is an append-only segmented log persisting chat history.
+//
+// Every record is framed as [4 byte length][4 byte crc32][payload], and the
+// payload is [1 byte op][8 byte id][data]. Records are replayed in segment
+// order, puts are idempotent by id, so a crash in the middle of a compaction
+// never loses or duplicates a message. A put replaced or removed is scrubbed,
+// overwritten in place by a deletion of the same size full of zeros.
+type historyStore struct {
+	mu sync.Mutex
+
+	dir         string
+	segments    []uint64
+	current     *os.File
+	currentSize int64
+
+	// where the latest put of every live record is
+	live    map[uint64]storeRecordPos
+	records int
+	nextID  uint64
+
+	// a compaction runs in the background, until Close, and after a failed
+	// one the next waits for records to double
+	compacting     bool
+	compactRecords int
+	closing        bool
+	compactions    sync.WaitGroup
+}
+
+type storeRecord struct {
+	id   uint64
+	data []byte
+}
+
+type storeRecordPos struct {
+	segment uint64
+	offset  int64
+	size    int64
+}
+
+const (
+	storeOpPut byte = iota
+	storeOpDel
+
+	storeSegmentSize       = 8 * 1024 * 1024
+	storeCompactMinRecords = 64
+	storeRecordHeader      = 4 + 4
+	storeRecordMeta        = 1 + 8
+	storeMaxRecord         = 1 << 30
+	storeSegmentExt        = ".seg"
+)
+
+var errCorruptedRecord = errors.New("corrupted record")
+
+// openHistoryStore opens or creates the store in dir and returns every live
+// record ordered by id.
+func openHistoryStore(dir string) (*historyStore, []storeRecord, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, nil, err
+	}
+
+	s := &historyStore{
+		dir:    dir,
+		live:   make(map[uint64]storeRecordPos),
+		nextID: 1,
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// leftover of an interrupted compaction
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, storeSegmentExt) {
+			continue
+		}
+		num, err := strconv.ParseUint(strings.TrimSuffix(name, storeSegmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, num)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	data := make(map[uint64][]byte)
+	// puts left behind by a crash before they were scrubbed
+	var stale []storeRecordPos
+	for i, num := range s.segments {
+		path := s.segmentPath(num)
+		valid, err := readSegment(path, func(offset int64, op byte, id uint64, payload []byte) {
+			s.records++
+			if pos, ok := s.live[id]; ok {
+				stale = append(stale, pos)
+			}
+			switch op {
+			case storeOpPut:
+				data[id] = payload
+				s.live[id] = storeRecordPos{num, offset, recordSize(payload)}
+			case storeOpDel:
+				delete(data, id)
+				delete(s.live, id)
+			}
+			if id >= s.nextID {
+				s.nextID = id + 1
+			}
+		})
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, errCorruptedRecord) {
+			return nil, nil, err
+		}
+		if i != len(s.segments)-1 {
+			log.Printf("history store: segment %s is corrupted after offset %d, skipping the rest of it", path, valid)
+			continue
+		}
+		log.Printf("history store: truncating corrupted tail segment %s at offset %d", path, valid)
+		if err := os.Truncate(path, valid); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, pos := range stale {
+		if err := scrub(s.segmentPath(pos.segment), pos); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(s.segments) == 0 {
+		if err := s.roll(0); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		last := s.segments[len(s.segments)-1]
+		f, err := os.OpenFile(s.segmentPath(last), os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		s.current = f
+		s.currentSize = info.Size()
+	}
+
+	records := make([]storeRecord, 0, len(data))
+	for id, payload := range data {
+		records = append(records, storeRecord{id, payload})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].id < records[j].id })
+
+	return s, records, nil
+}
+
+// Append persists data and returns the id assigned to it.
+func (s *historyStore) Append(data []byte) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.nextID
+	pos, err := s.write(storeOpPut, id, data)
+	if err != nil {
+		return 0, err
+	}
+	s.nextID++
+	s.live[id] = pos
+	return id, nil
+}
+
+// Replace overwrites the live record id with data, and scrubs the former data
+// from the disk.
+func (s *historyStore) Replace(id uint64, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	former, ok := s.live[id]
+	if !ok {
+		return nil
+	}
+	pos, err := s.write(storeOpPut, id, data)
+	if err != nil {
+		return err
+	}
+	s.live[id] = pos
+	if err := scrub(s.segmentPath(former.segment), former); err != nil {
+		return err
+	}
+	s.compactGarbage()
+	return nil
+}
+
+// Remove marks the records as deleted and scrubs their data from the disk.
+func (s *historyStore) Remove(ids ...uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		former, ok := s.live[id]
+		if !ok {
+			continue
+		}
+		if _, err := s.write(storeOpDel, id, nil); err != nil {
+			return err
+		}
+		delete(s.live, id)
+		if err := scrub(s.segmentPath(former.segment), former); err != nil {
+			return err
+		}
+	}
+	s.compactGarbage()
+	return nil
+}
+
+// compactGarbage starts compacting the log in the background when most of it
+// is garbage. s.mu must be held.
+func (s *historyStore) compactGarbage() {
+	if s.compacting || s.closing || s.records <= storeCompactMinRecords || s.records <= 2*len(s.live) || s.records < s.compactRecords {
+		return
+	}
+	s.compacting = true
+	s.compactions.Add(1)
+	go func() {
+		defer s.compactions.Done()
+		if err := s.compact(); err != nil {
+			log.Println("history store: compaction failed:", err)
+			s.mu.Lock()
+			s.compactRecords = 2 * s.records
+			s.mu.Unlock()
+		}
+	}()
+}
+
+// Close waits for a running compaction, and flushes and closes the current
+// segment.
+func (s *historyStore) Close() error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	s.compactions.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == nil {
+		return nil
+	}
+	s.current.Sync()
+	err := s.current.Close()
+	s.current = nil
+	return err
+}
+
+func (s *historyStore) segmentPath(num uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016x%s", num, storeSegmentExt))
+}
+
+// roll makes the segment num the current one, num must be after the others.
+func (s *historyStore) roll(num uint64) error {
+	f, err := os.OpenFile(s.segmentPath(num), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if s.current != nil {
+		s.current.Sync()
+		s.current.Close()
+	}
+	s.segments = append(s.segments, num)
+	s.current = f
+	s.currentSize = 0
+	return nil
+}
+
+func (s *historyStore) write(op byte, id uint64, data []byte) (storeRecordPos, error) {
+	if s.current == nil {
+		return storeRecordPos{}, os.ErrClosed
+	}
+	if s.currentSize >= storeSegmentSize {
+		if err := s.roll(s.segments[len(s.segments)-1] + 1); err != nil {
+			return storeRecordPos{}, err
+		}
+	}
+	pos := storeRecordPos{s.segments[len(s.segments)-1], s.currentSize, recordSize(data)}
+	n, err := s.current.Write(encodeRecord(op, id, data))
+	s.currentSize += int64(n)
+	if err != nil {
+		return storeRecordPos{}, err
+	}
+	s.records++
+	return pos, nil
+}
+
+// scrub overwrites the put at pos in the segment file path with a deletion of
+// the same size, so its data is gone from the disk while the segment stays
+// readable.
+func scrub(path string, pos storeRecordPos) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	// the id is zeroed too, a deletion of no record
+	record := encodeRecord(storeOpDel, 0, make([]byte, pos.size-storeRecordHeader-storeRecordMeta))
+	_, err = f.WriteAt(record, pos.offset)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// compact rewrites every live record into a fresh segment and drops the
+// older ones. Appends go on meanwhile to the segments after it, only the
+// snapshot of the records to copy and the swap of the segments hold s.mu.
+func (s *historyStore) compact() error {
+	s.mu.Lock()
+	old := append([]uint64(nil), s.segments...)
+	num := old[len(old)-1] + 1
+	if err := s.roll(num + 1); err != nil {
+		s.compacting = false
+		s.mu.Unlock()
+		return err
+	}
+	live := make(map[uint64]storeRecordPos, len(s.live))
+	for id, pos := range s.live {
+		live[id] = pos
+	}
+	records := s.records
+	s.mu.Unlock()
+
+	path := s.segmentPath(num)
+	tmp := path + ".tmp"
+	copied, writeErr := s.copyRecords(live, num, tmp)
+	written := len(copied)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compacting = false
+	if writeErr == nil {
+		for id, pos := range copied {
+			if s.live[id] == live[id] {
+				continue
+			}
+			// replaced or removed meanwhile, maybe after it was copied
+			if writeErr = scrub(tmp, pos); writeErr != nil {
+				break
+			}
+			delete(copied, id)
+		}
+	}
+	if writeErr == nil {
+		for id, pos := range live {
+			if _, ok := copied[id]; !ok && s.live[id] == pos {
+				writeErr = fmt.Errorf("history store: record %d could not be copied", id)
+				break
+			}
+		}
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(tmp, path)
+	}
+	if writeErr != nil {
+		os.Remove(tmp)
+		return writeErr
+	}
+
+	for id, pos := range copied {
+		s.live[id] = pos
+	}
+	for _, seg := range old {
+		os.Remove(s.segmentPath(seg))
+	}
+	s.segments = append([]uint64{num}, s.segments[len(old):]...)
+	s.records = written + s.records - records
+	return nil
+}
+
+// copyRecords writes the records at the positions of live into path, the
+// segment num to be, and returns their positions in it. The ones scrubbed
+// meanwhile are left out.
+func (s *historyStore) copyRecords(live map[uint64]storeRecordPos, num uint64, path string) (map[uint64]storeRecordPos, error) {
+	ids := make([]uint64, 0, len(live))
+	for id := range live {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	segments := make(map[uint64]*os.File)
+	defer func() {
+		for _, seg := range segments {
+			seg.Close()
+		}
+	}()
+
+	copied := make(map[uint64]storeRecordPos, len(live))
+	var size int64
+	for _, id := range ids {
+		pos := live[id]
+		seg, ok := segments[pos.segment]
+		if !ok {
+			if seg, err = os.Open(s.segmentPath(pos.segment)); err != nil {
+				return nil, err
+			}
+			segments[pos.segment] = seg
+		}
+		record := make([]byte, pos.size)
+		if _, err := seg.ReadAt(record, pos.offset); err != nil {
+			return nil, err
+		}
+		op, recordID, data, err := decodeRecord(record)
+		if err != nil || op != storeOpPut || recordID != id {
+			// scrubbed meanwhile
+			continue
+		}
+		copied[id] = storeRecordPos{num, size, pos.size}
+		n, err := w.Write(encodeRecord(op, id, data))
+		size += int64(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return copied, f.Sync()
+}
+
+// recordSize returns the size on disk of the record holding data.
+func recordSize(data []byte) int64 {
+	return int64(storeRecordHeader + storeRecordMeta + len(data))
+}
+
+func encodeRecord(op byte, id uint64, data []byte) []byte {
+	record := make([]byte, storeRecordHeader+storeRecordMeta+len(data))
+	payload := record[storeRecordHeader:]
+	payload[0] = op
+	binary.BigEndian.PutUint64(payload[1:], id)
+	copy(payload[storeRecordMeta:], data)
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	return record
+}
+
+// decodeRecord decodes a record read at its position.
+func decodeRecord(record []byte) (op byte, id uint64, data []byte, err error) {
+	if len(record) < storeRecordHeader+storeRecordMeta {
+		return 0, 0, nil, errCorruptedRecord
+	}
+	payload := record[storeRecordHeader:]
+	if int(binary.BigEndian.Uint32(record)) != len(payload) || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(record[4:]) {
+		return 0, 0, nil, errCorruptedRecord
+	}
+	return payload[0], binary.BigEndian.Uint64(payload[1:]), payload[storeRecordMeta:], nil
+}
+
+// readSegment calls fn for every intact record in the segment with its offset,
+// and returns the offset right after the last intact one.
+func readSegment(path string, fn func(offset int64, op byte, id uint64, data []byte)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	header := make([]byte, storeRecordHeader)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return offset, errCorruptedRecord
+			}
+			return offset, err
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length < storeRecordMeta || length > storeMaxRecord {
+			return offset, errCorruptedRecord
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return offset, errCorruptedRecord
+			}
+			return offset, err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return offset, errCorruptedRecord
+		}
+		fn(offset, payload[0], binary.BigEndian.Uint64(payload[1:]), payload[storeRecordMeta:])
+		offset += int64(storeRecordHeader) + int64(length)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// reopenStore closes s and opens its directory again.
+func reopenStore(t *testing.T, s *historyStore) (*historyStore, map[uint64]string) {
+	t.Helper()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, records, err := openHistoryStore(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, recordMap(t, records)
+}
+
+func recordMap(t *testing.T, records []storeRecord) map[uint64]string {
+	t.Helper()
+	m := make(map[uint64]string, len(records))
+	for i, record := range records {
+		if i > 0 && records[i-1].id >= record.id {
+			t.Fatalf("records out of order: %d after %d", record.id, records[i-1].id)
+		}
+		m[record.id] = string(record.data)
+	}
+	return m
+}
+
+// assertScrubbed fails if any segment in dir still contains data.
+func assertScrubbed(t *testing.T, dir string, data ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range data {
+			if bytes.Contains(content, []byte(d)) {
+				t.Errorf("%q is left in %s", d, entry.Name())
+			}
+		}
+	}
+}
+
+// writeSegments creates the segment files num of records in dir.
+func writeSegments(t *testing.T, dir string, segments map[uint64][][]byte) {
+	t.Helper()
+	for num, records := range segments {
+		path := filepath.Join(dir, fmt.Sprintf("%016x%s", num, storeSegmentExt))
+		if err := os.WriteFile(path, bytes.Join(records, nil), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHistoryStoreAppendReload(t *testing.T) {
+	s, records, err := openHistoryStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("new store has %d records", len(records))
+	}
+	want := make(map[uint64]string)
+	for _, data := range []string{"a", "", "ccc"} {
+		id, err := s.Append([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[id] = data
+	}
+
+	s, got := reopenStore(t, s)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("reloaded %v, want %v", got, want)
+	}
+	id, err := s.Append([]byte("d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := want[id]; ok || id == 0 {
+		t.Fatalf("id %d issued again after reload", id)
+	}
+	want[id] = "d"
+	if _, got = reopenStore(t, s); !reflect.DeepEqual(got, want) {
+		t.Fatalf("reloaded %v, want %v", got, want)
+	}
+}
+
+func TestHistoryStoreReplaceRemove(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := openHistoryStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited, _ := s.Append([]byte("secret edited"))
+	removed, _ := s.Append([]byte("secret removed"))
+	kept, _ := s.Append([]byte("kept"))
+	if err := s.Replace(edited, []byte("edit")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+	// no-ops
+	if err := s.Replace(removed, []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(removed, 1000); err != nil {
+		t.Fatal(err)
+	}
+	assertScrubbed(t, dir, "secret")
+
+	_, got := reopenStore(t, s)
+	if want := map[uint64]string{edited: "edit", kept: "kept"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("reloaded %v, want %v", got, want)
+	}
+}
+
+func TestHistoryStoreRecovery(t *testing.T) {
+	a := encodeRecord(storeOpPut, 1, []byte("a"))
+	b := encodeRecord(storeOpPut, 2, []byte("b"))
+	c := encodeRecord(storeOpPut, 3, []byte("c"))
+	badCRC := append([]byte(nil), b...)
+	badCRC[len(badCRC)-1] ^= 0xff
+	badLength := append([]byte(nil), b...)
+	badLength[0] = 0xff
+
+	tests := []struct {
+		name     string
+		segments map[uint64][][]byte
+		want     map[uint64]string
+		// size of the last segment once truncated, -1 if untouched
+		truncated int
+	}{
+		{"intact", map[uint64][][]byte{0: {a, b}, 1: {c}}, map[uint64]string{1: "a", 2: "b", 3: "c"}, -1},
+		{"truncated tail", map[uint64][][]byte{0: {a, b[:len(b)-1]}}, map[uint64]string{1: "a"}, len(a)},
+		{"truncated header", map[uint64][][]byte{0: {a, b[:3]}}, map[uint64]string{1: "a"}, len(a)},
+		{"crc mismatch in tail", map[uint64][][]byte{0: {a, badCRC, c}}, map[uint64]string{1: "a"}, len(a)},
+		{"length beyond the file", map[uint64][][]byte{0: {a, badLength}}, map[uint64]string{1: "a"}, len(a)},
+		{"crc mismatch before tail", map[uint64][][]byte{0: {a, badCRC, c}, 1: {encodeRecord(storeOpPut, 4, []byte("d"))}}, map[uint64]string{1: "a", 4: "d"}, -1},
+		{"deleted", map[uint64][][]byte{0: {a, b, encodeRecord(storeOpDel, 1, nil)}}, map[uint64]string{2: "b"}, -1},
+		{"put again by a compaction", map[uint64][][]byte{0: {a, b}, 1: {encodeRecord(storeOpPut, 1, []byte("a"))}}, map[uint64]string{1: "a", 2: "b"}, -1},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		writeSegments(t, dir, tt.segments)
+		os.WriteFile(filepath.Join(dir, "0000000000000009"+storeSegmentExt+".tmp"), c, 0o600)
+
+		s, records, err := openHistoryStore(dir)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := recordMap(t, records); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: loaded %v, want %v", tt.name, got, tt.want)
+		}
+		last := s.segmentPath(s.segments[len(s.segments)-1])
+		info, err := os.Stat(last)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.truncated >= 0 && info.Size() != int64(tt.truncated) {
+			t.Errorf("%s: last segment is %d bytes, want it truncated to %d", tt.name, info.Size(), tt.truncated)
+		}
+		if matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(matches) != 0 {
+			t.Errorf("%s: leftover %v not removed", tt.name, matches)
+		}
+
+		// appending goes on after the intact records
+		id, err := s.Append([]byte("new"))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		want := map[uint64]string{id: "new"}
+		for id, data := range tt.want {
+			want[id] = data
+		}
+		if _, got := reopenStore(t, s); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: reloaded %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestHistoryStoreDuplicateScrubbed(t *testing.T) {
+	dir := t.TempDir()
+	// a crash after a put replacing another, before the latter was scrubbed
+	writeSegments(t, dir, map[uint64][][]byte{
+		0: {encodeRecord(storeOpPut, 1, []byte("secret"))},
+		1: {encodeRecord(storeOpPut, 1, []byte("edit"))},
+	})
+	s, records, err := openHistoryStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got, want := recordMap(t, records), map[uint64]string{1: "edit"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("loaded %v, want %v", got, want)
+	}
+	assertScrubbed(t, dir, "secret")
+}
+
+func TestHistoryStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := openHistoryStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[uint64]string)
+	var removed []uint64
+	for i := 0; i < 4*storeCompactMinRecords; i++ {
+		data := fmt.Sprintf("message %d", i)
+		id, err := s.Append([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%8 == 0 {
+			want[id] = data
+		} else {
+			removed = append(removed, id)
+		}
+	}
+	if err := s.Remove(removed...); err != nil {
+		t.Fatal(err)
+	}
+	// Close waits for the compaction started by the removal
+	s, got := reopenStore(t, s)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("reloaded %v, want %v", got, want)
+	}
+	if s.records != len(want) {
+		t.Errorf("%d records left for %d live ones", s.records, len(want))
+	}
+}
+
+func TestHistoryStoreCompactionConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := openHistoryStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[uint64]string)
+	var ids []uint64
+	for i := 0; i < 200; i++ {
+		data := fmt.Sprintf("message %03d", i)
+		id, err := s.Append([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[id] = data
+		ids = append(ids, id)
+	}
+
+	s.mu.Lock()
+	s.compacting = true
+	s.mu.Unlock()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := s.compact(); err != nil {
+			t.Error(err)
+		}
+	}()
+	// edits, deletions and new messages while the records are copied
+	var mu sync.Mutex
+	for i, id := range ids {
+		switch i % 4 {
+		case 0:
+			data := fmt.Sprintf("edit %d", i)
+			if err := s.Replace(id, []byte(data)); err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			want[id] = data
+			mu.Unlock()
+		case 1:
+			if err := s.Remove(id); err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			delete(want, id)
+			mu.Unlock()
+		case 2:
+			data := fmt.Sprintf("new %d", i)
+			id, err := s.Append([]byte(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			want[id] = data
+			mu.Unlock()
+		}
+	}
+	wg.Wait()
+
+	if _, got := reopenStore(t, s); !reflect.DeepEqual(got, want) {
+		t.Fatalf("reloaded %d records, want %d: %v", len(got), len(want), got)
+	}
+	for i := 0; i < 200; i += 4 {
+		assertScrubbed(t, dir, fmt.Sprintf("message %03d", i), fmt.Sprintf("message %03d", i+1))
+	}
+}